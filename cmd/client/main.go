@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
-	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/kubescape/go-logger"
 	"github.com/kubescape/go-logger/helpers"
 	"github.com/matthyx/synchro-poc/config"
@@ -16,6 +20,9 @@ import (
 )
 
 func main() {
+	// stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	// config
 	cfg, err := config.LoadConfig("./configuration")
 	if err != nil {
@@ -27,15 +34,31 @@ func main() {
 		logger.L().Fatal("unable to create k8s client", helpers.Error(err))
 	}
 	// websocket client
-	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws://127.0.0.1:8080/")
+	dialer, err := synchro.NewDialer(cfg)
 	if err != nil {
-		logger.L().Fatal("unable to create websocket connection", helpers.Error(err))
+		logger.L().Fatal("unable to create websocket dialer", helpers.Error(err))
 	}
-	defer conn.Close()
-	// outgoing message pool
+	conn := synchro.NewConn(cfg, dialer)
+	// metrics, including the bytes saved by compression
+	var metricsServer *http.Server
+	if cfg.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsListen,
+			Handler: mux,
+		}
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.L().Error("unable to serve metrics", helpers.Error(err))
+			}
+		}()
+	}
+	// outgoing message pool, messages are kept in the outbox of the connection
+	// until the server acknowledges them, also across reconnections
 	outPool, err := ants.NewPoolWithFunc(10, func(i interface{}) {
-		data := i.([]byte)
-		err = wsutil.WriteClientBinary(conn, data)
+		err := conn.Write(i.(synchro.Message))
 		if err != nil {
 			logger.L().Error("cannot send message", helpers.Error(err))
 			return
@@ -44,80 +67,140 @@ func main() {
 	if err != nil {
 		logger.L().Fatal("unable to create outgoing message pool", helpers.Error(err))
 	}
-	// etcd watches
 	clients := map[string]*synchro.Client{}
 	for _, r := range cfg.Resources {
-		syncClient := synchro.NewClient(cfg, client, outPool, r)
+		syncClient, err := synchro.NewClient(cfg, client, outPool, r)
+		if err != nil {
+			logger.L().Fatal("unable to create synchro client", helpers.Error(err))
+		}
 		clients[r.String()] = syncClient
-		go syncClient.Run()
 	}
-	// incoming messages
-	for {
-		data, err := wsutil.ReadServerBinary(conn)
+	// etcd watches are started on the first connection, and resynced on the next ones
+	var watches sync.WaitGroup
+	// started is only accessed by onConnect, called by Run from its goroutine
+	var started bool
+	onConnect := func() {
+		// features are enabled according to the capabilities of the server
+		session := conn.Session()
+		first := !started
+		started = true
+		for _, syncClient := range clients {
+			syncClient := syncClient
+			syncClient.UseSession(session)
+			watches.Add(1)
+			go func() {
+				defer watches.Done()
+				if first {
+					syncClient.Run(ctx)
+					return
+				}
+				err := syncClient.Resync(ctx)
+				if err != nil {
+					logger.L().Error("cannot resync objects", helpers.Error(err))
+				}
+			}()
+		}
+	}
+	// websocket connection, re-dialed when lost
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Run(ctx, func(data []byte) {
+			handleMessage(conn.Session().Codec(), data, clients)
+		}, onConnect)
+	}()
+	<-ctx.Done()
+	logger.L().Info("shutting down")
+	// stop watches, then drain queued outgoing messages
+	watches.Wait()
+	err = outPool.ReleaseTimeout(cfg.ShutdownTimeout)
+	if err != nil {
+		logger.L().Error("cannot drain outgoing messages", helpers.Error(err))
+	}
+	// close the connection, waiting for the server to acknowledge it
+	err = conn.Close(cfg.ShutdownTimeout)
+	if err != nil {
+		logger.L().Warning("cannot close connection", helpers.Error(err))
+	}
+	<-done
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+}
+
+func handleMessage(codec domain.Codec, data []byte, clients map[string]*synchro.Client) {
+	// unmarshal message
+	var msg domain.Generic
+	err := codec.Unmarshal(data, &msg)
+	if err != nil {
+		logger.L().Error("cannot unmarshal message", helpers.Error(err))
+		return
+	}
+	switch *msg.Event {
+	case domain.EventAdd:
+		logger.L().Info("received add message", helpers.Interface("event", msg.Event.Value()))
+		var add domain.Add
+		err = codec.Unmarshal(data, &add)
 		if err != nil {
-			logger.L().Error("cannot read server data", helpers.Error(err))
-			break
+			logger.L().Error("cannot unmarshal add message", helpers.Error(err))
+			return
 		}
-		// unmarshal message
-		var msg domain.Generic
-		err = json.Unmarshal(data, &msg)
+		err := clients[msg.Kind.String()].HandleSyncAdd(add.Name, []byte(add.Object), add.OperationId)
 		if err != nil {
-			logger.L().Error("cannot unmarshal message", helpers.Error(err))
-			continue
+			logger.L().Error("error handling add message", helpers.Error(err))
+			return
 		}
-		switch *msg.Event {
-		case domain.EventAdd:
-			logger.L().Info("received add message", helpers.Interface("event", msg.Event.Value()))
-			var add domain.Add
-			err = json.Unmarshal(data, &add)
-			if err != nil {
-				logger.L().Error("cannot unmarshal add message", helpers.Error(err))
-				continue
-			}
-			err := clients[msg.Kind.String()].HandleSyncAdd(add.Name, []byte(add.Object))
-			if err != nil {
-				logger.L().Error("error handling add message", helpers.Error(err))
-				continue
-			}
-		case domain.EventDelete:
-			logger.L().Info("received delete message", helpers.Interface("event", msg.Event.Value()))
-			var del domain.Delete
-			err = json.Unmarshal(data, &del)
-			if err != nil {
-				logger.L().Error("cannot unmarshal delete message", helpers.Error(err))
-				continue
-			}
-			err := clients[msg.Kind.String()].HandleSyncDelete(del.Name)
-			if err != nil {
-				logger.L().Error("error handling delete message", helpers.Error(err))
-				continue
-			}
-		case domain.EventRetrieve:
-			logger.L().Info("received retrieve message", helpers.Interface("event", msg.Event.Value()))
-			var ret domain.Retrieve
-			err = json.Unmarshal(data, &ret)
-			if err != nil {
-				logger.L().Error("cannot unmarshal retrieve message", helpers.Error(err))
-				continue
-			}
-			err := clients[msg.Kind.String()].HandleSyncRetrieve(ret.Name)
-			if err != nil {
-				logger.L().Error("error handling retrieve message", helpers.Error(err))
-				continue
-			}
-		case domain.EventUpdateShadow:
-			logger.L().Info("received update shadow message", helpers.Interface("event", msg.Event.Value()))
-			var upd domain.UpdateShadow
-			err = json.Unmarshal(data, &upd)
-			if err != nil {
-				logger.L().Error("cannot unmarshal update shadow message", helpers.Error(err))
-				continue
-			}
-			err := clients[msg.Kind.String()].HandleSyncUpdateShadow(upd.Name, []byte(upd.Object))
-			if err != nil {
-				logger.L().Error("error handling update shadow message", helpers.Error(err))
-				continue
-			}
+	case domain.EventDelete:
+		logger.L().Info("received delete message", helpers.Interface("event", msg.Event.Value()))
+		var del domain.Delete
+		err = codec.Unmarshal(data, &del)
+		if err != nil {
+			logger.L().Error("cannot unmarshal delete message", helpers.Error(err))
+			return
+		}
+		err := clients[msg.Kind.String()].HandleSyncDelete(del.Name, del.OperationId)
+		if err != nil {
+			logger.L().Error("error handling delete message", helpers.Error(err))
+			return
+		}
+	case domain.EventRetrieve:
+		logger.L().Info("received retrieve message", helpers.Interface("event", msg.Event.Value()))
+		var ret domain.Retrieve
+		err = codec.Unmarshal(data, &ret)
+		if err != nil {
+			logger.L().Error("cannot unmarshal retrieve message", helpers.Error(err))
+			return
+		}
+		err := clients[msg.Kind.String()].HandleSyncRetrieve(ret.Name)
+		if err != nil {
+			logger.L().Error("error handling retrieve message", helpers.Error(err))
+			return
+		}
+	case domain.EventRetrieveInventory:
+		logger.L().Info("received retrieve inventory message", helpers.Interface("event", msg.Event.Value()))
+		var ret domain.RetrieveInventory
+		err = codec.Unmarshal(data, &ret)
+		if err != nil {
+			logger.L().Error("cannot unmarshal retrieve inventory message", helpers.Error(err))
+			return
+		}
+		err := clients[msg.Kind.String()].HandleSyncRetrieveInventory(ret.Namespaces)
+		if err != nil {
+			logger.L().Error("error handling retrieve inventory message", helpers.Error(err))
+			return
+		}
+	case domain.EventUpdateShadow:
+		logger.L().Info("received update shadow message", helpers.Interface("event", msg.Event.Value()))
+		var upd domain.UpdateShadow
+		err = codec.Unmarshal(data, &upd)
+		if err != nil {
+			logger.L().Error("cannot unmarshal update shadow message", helpers.Error(err))
+			return
+		}
+		err := clients[msg.Kind.String()].HandleSyncUpdateShadow(upd.Name, []byte(upd.Object))
+		if err != nil {
+			logger.L().Error("error handling update shadow message", helpers.Error(err))
+			return
 		}
 	}
 }
@@ -1,149 +1,166 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
-	jsonpatch "github.com/evanphx/json-patch"
-	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/kubescape/go-logger"
 	"github.com/kubescape/go-logger/helpers"
-	"github.com/matthyx/synchro-poc/domain"
-	"github.com/matthyx/synchro-poc/utils"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/server"
+	"github.com/matthyx/synchro-poc/store"
 )
 
 func main() {
-	resources := map[string][]byte{}
+	// config
+	cfg, err := config.LoadServerConfig("./configuration")
+	if err != nil {
+		logger.L().Fatal("unable to load configuration", helpers.Error(err))
+	}
+	// storage, existing state is loaded before accepting connections
+	s, err := newStore(cfg.Store)
+	if err != nil {
+		logger.L().Fatal("unable to create store", helpers.Error(err))
+	}
+	// authentication
+	var auth *server.Authenticator
+	if len(cfg.Auth.Credentials) > 0 {
+		auth, err = server.NewAuthenticator(cfg.Auth.Credentials)
+		if err != nil {
+			logger.L().Fatal("unable to create authenticator", helpers.Error(err))
+		}
+	} else {
+		logger.L().Warning("no credentials configured, authentication of clients and HTTP APIs is disabled")
+	}
+	srv := server.NewServer(s, auth)
+	err = srv.UseCompression(cfg.Compression)
+	if err != nil {
+		logger.L().Fatal("unable to configure compression", helpers.Error(err))
+	}
+	mux := http.NewServeMux()
+	// read-only query API, the HTTP APIs authenticate like the websocket
+	mux.Handle("/clusters", srv.QueryHandler())
+	mux.Handle("/clusters/", srv.QueryHandler())
+	// desired state pushed to the clusters, which force-apply it, so not served to anonymous callers
+	if auth != nil {
+		mux.Handle("/desired/", srv.DesiredStateHandler())
+	} else {
+		logger.L().Warning("no credentials configured, the desired state API is disabled")
+	}
+	// change feed
+	mux.Handle("/watch", srv.ChangeFeedHandler())
 	// websocket server
-	http.ListenAndServe(":8080", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
+	mux.Handle("/", srv)
+	httpServer := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: mux,
+	}
+	if cfg.TLS.CertFile != "" {
+		httpServer.TLSConfig, err = newTLSConfig(cfg.TLS)
 		if err != nil {
-			logger.L().Error("unable to upgrade connection", helpers.Error(err))
-			return
+			logger.L().Fatal("unable to configure TLS", helpers.Error(err))
+		}
+	}
+	// metrics, including the bytes saved by compression, on their own listener
+	var metricsServer *http.Server
+	if cfg.MetricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/debug/vars", expvar.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsListen,
+			Handler: metricsMux,
 		}
-
 		go func() {
-			defer conn.Close()
-
-			for {
-				data, err := wsutil.ReadClientBinary(conn)
-				if err != nil {
-					logger.L().Error("cannot read client data", helpers.Error(err))
-					break
-				}
-				// unmarshal message
-				var msg domain.Generic
-				err = json.Unmarshal(data, &msg)
-				if err != nil {
-					logger.L().Error("cannot unmarshal message", helpers.Error(err))
-					continue
-				}
-				logger.L().Debug("received message", helpers.Interface("event", msg.Event.Value()))
-				switch *msg.Event {
-				case domain.EventAdd:
-					var add domain.Add
-					err = json.Unmarshal(data, &add)
-					if err != nil {
-						logger.L().Error("cannot unmarshal add", helpers.Error(err))
-						continue
-					}
-					logger.L().Info("adding object",
-						helpers.String("kind", add.Kind.Resource),
-						helpers.String("resource", add.Name),
-						helpers.Int("size", len(add.Object)))
-					if existingObj, ok := resources[add.Name]; ok {
-						oldHash, _ := utils.CanonicalHash(existingObj)
-						newHash, _ := utils.CanonicalHash([]byte(add.Object))
-						logger.L().Info("object already exists",
-							helpers.String("old checksum", oldHash),
-							helpers.String("new checksum", newHash))
-					}
-					resources[add.Name] = []byte(add.Object)
-				case domain.EventChecksum:
-					var checksum domain.Checksum
-					err = json.Unmarshal(data, &checksum)
-					if err != nil {
-						logger.L().Error("cannot unmarshal checksum", helpers.Error(err))
-						continue
-					}
-					// check if checksum is correct
-					localChecksum, _ := utils.CanonicalHash(resources[checksum.Name])
-					if localChecksum == checksum.Checksum {
-						logger.L().Info("checksum is correct",
-							helpers.String("kind", checksum.Kind.Resource),
-							helpers.String("resource", checksum.Name),
-							helpers.String("checksum", checksum.Checksum))
-						continue
-					} else {
-						logger.L().Warning("checksum is wrong",
-							helpers.String("kind", checksum.Kind.Resource),
-							helpers.String("resource", checksum.Name),
-							helpers.String("local checksum", localChecksum),
-							helpers.String("remote checksum", checksum.Checksum))
-					}
-					// wrong checksum, ask for retrieve
-					event := domain.EventRetrieve
-					resp := domain.Retrieve{
-						Cluster: checksum.Cluster,
-						Kind:    checksum.Kind,
-						Name:    checksum.Name,
-						Event:   &event,
-					}
-					respData, err := json.Marshal(resp)
-					if err != nil {
-						logger.L().Error("cannot marshal retrieve", helpers.Error(err))
-						continue
-					}
-					err = wsutil.WriteServerBinary(conn, respData)
-					if err != nil {
-						logger.L().Error("cannot write retrieve", helpers.Error(err))
-						continue
-					}
-				case domain.EventDelete:
-					var del domain.Delete
-					err = json.Unmarshal(data, &del)
-					if err != nil {
-						logger.L().Error("cannot unmarshal delete", helpers.Error(err))
-						continue
-					}
-					delete(resources, del.Name)
-				case domain.EventPatch:
-					var patch domain.Patch
-					err = json.Unmarshal(data, &patch)
-					if err != nil {
-						logger.L().Error("cannot unmarshal patch", helpers.Error(err))
-						continue
-					}
-					// apply patch
-					modified, err := jsonpatch.MergePatch(resources[patch.Name], []byte(patch.Patch))
-					if err != nil {
-						logger.L().Error("cannot apply patch", helpers.Error(err))
-						logger.L().Debug("send update shadow", helpers.String("key", patch.Name))
-						event := domain.EventUpdateShadow
-						resp := domain.UpdateShadow{
-							Cluster: patch.Cluster,
-							Kind:    patch.Kind,
-							Name:    patch.Name,
-							Event:   &event,
-							Object:  string(resources[patch.Name]),
-						}
-						respData, err := json.Marshal(resp)
-						if err != nil {
-							logger.L().Error("cannot marshal updateShadow", helpers.Error(err))
-							continue
-						}
-						err = wsutil.WriteServerBinary(conn, respData)
-						if err != nil {
-							logger.L().Error("cannot write updateShadow", helpers.Error(err))
-							continue
-						}
-						continue
-					}
-					// update in known resources
-					resources[patch.Name] = modified
-				}
+			err := metricsServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.L().Error("unable to serve metrics", helpers.Error(err))
 			}
 		}()
-	}))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		if cfg.TLS.CertFile != "" {
+			err = httpServer.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		logger.L().Fatal("unable to serve", helpers.Error(err))
+	case <-ctx.Done():
+	}
+	// graceful shutdown, websocket clients are told to close their connections
+	logger.L().Info("shutting down", helpers.String("timeout", cfg.ShutdownTimeout.String()))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.L().Warning("websocket connections did not close in time", helpers.Error(err))
+	}
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.L().Warning("unable to shut down HTTP server", helpers.Error(err))
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	// pending writes are flushed to disk when the store is closed
+	err = s.Close()
+	if err != nil {
+		logger.L().Error("unable to close store", helpers.Error(err))
+	}
+}
+
+// newTLSConfig verifies client certificates against the configured CA, if any.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+	ca, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+	}
+	// clients can still authenticate with a bearer token
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+func newStore(cfg config.StoreConfig) (store.Store, error) {
+	switch cfg.Type {
+	case "memory":
+		return store.NewMemoryStore(), nil
+	case "bolt":
+		b, err := store.NewBoltStore(cfg.DataDir, cfg.Fsync, cfg.FsyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		count, err := b.Count()
+		if err != nil {
+			_ = b.Close()
+			return nil, fmt.Errorf("load existing objects: %w", err)
+		}
+		logger.L().Info("loaded existing objects", helpers.String("dataDir", cfg.DataDir), helpers.Int("count", count))
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown store type %q", cfg.Type)
 }
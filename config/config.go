@@ -1,22 +1,206 @@
 package config
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
 	Cluster   string     `mapstructure:"cluster"`
+	Server    string     `mapstructure:"server"`
+	Token     string     `mapstructure:"token"`
+	TLS       TLSConfig  `mapstructure:"tls"`
 	Resources []Resource `mapstructure:"resources"`
+	// ShutdownTimeout bounds the time spent draining outgoing messages on shutdown
+	ShutdownTimeout time.Duration   `mapstructure:"shutdownTimeout"`
+	Reconnect       ReconnectConfig `mapstructure:"reconnect"`
+	// AckTimeout is the time after which a message not acknowledged by the server is sent again
+	AckTimeout time.Duration `mapstructure:"ackTimeout"`
+	// ResyncPeriod is the interval at which the informers replay their cache,
+	// changes not sent yet are then caught up
+	ResyncPeriod time.Duration `mapstructure:"resyncPeriod"`
+	// FieldManager owns the fields of the objects applied on behalf of the server
+	FieldManager string `mapstructure:"fieldManager"`
+	// Encoding of the messages, "json" or "cbor" if supported by the server
+	Encoding    string            `mapstructure:"encoding"`
+	Compression CompressionConfig `mapstructure:"compression"`
+	// MetricsListen is the address serving the metrics on /debug/vars, disabled if empty,
+	// they are not authenticated and include the command line
+	MetricsListen string `mapstructure:"metricsListen"`
+}
+
+// CompressionConfig compresses the messages of at least Threshold bytes with
+// zstd at Level, from 1 (fastest) to 22 (smallest), if supported by the peer.
+type CompressionConfig struct {
+	Enabled   bool `mapstructure:"enabled"`
+	Threshold int  `mapstructure:"threshold"`
+	Level     int  `mapstructure:"level"`
+}
+
+// Validate checks the threshold and the level.
+func (c CompressionConfig) Validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("negative compression threshold %d", c.Threshold)
+	}
+	if c.Level < 1 || c.Level > 22 {
+		return fmt.Errorf("compression level %d is not between 1 and 22", c.Level)
+	}
+	return nil
+}
+
+// ReconnectConfig bounds the exponential backoff between reconnection attempts,
+// a random jitter of up to 50% is applied to each interval.
+type ReconnectConfig struct {
+	InitialInterval time.Duration `mapstructure:"initialInterval"`
+	MaxInterval     time.Duration `mapstructure:"maxInterval"`
+}
+
+// TLSConfig holds the certificates used by the client or the server,
+// the client certificate is only used for mTLS.
+type TLSConfig struct {
+	CAFile   string `mapstructure:"caFile"`
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
 }
 
 type Resource struct {
-	Group    string          `mapstructure:"group"`
-	Version  string          `mapstructure:"version"`
-	Resource string          `mapstructure:"resource"`
-	Strategy domain.Strategy `mapstructure:"strategy"`
+	Group     string          `mapstructure:"group"`
+	Version   string          `mapstructure:"version"`
+	Resource  string          `mapstructure:"resource"`
+	Strategy  domain.Strategy `mapstructure:"strategy"`
+	FetchMode FetchMode       `mapstructure:"fetchMode"`
+	// Namespaces restricts the synchronized objects to these namespaces,
+	// all namespaces but ExcludeNamespaces are synchronized if empty
+	Namespaces        []string `mapstructure:"namespaces"`
+	ExcludeNamespaces []string `mapstructure:"excludeNamespaces"`
+	LabelSelector     string   `mapstructure:"labelSelector"`
+	FieldSelector     string   `mapstructure:"fieldSelector"`
+	// Drop lists the paths of the fields removed from the objects before they are
+	// hashed and sent, in addition to DefaultDrop, and Redact the ones whose value
+	// is masked. Paths are written as parsed by utils.ParsePath.
+	Drop   []string `mapstructure:"drop"`
+	Redact []string `mapstructure:"redact"`
+	// ChecksumIgnore lists the paths ignored by checksums in addition to
+	// utils.DefaultIgnorePaths, written like Drop but without [*] or quoted field
+	// names. They are sent to the server in hello.
+	ChecksumIgnore []string `mapstructure:"checksumIgnore"`
+}
+
+// DefaultDrop removes the fields changing without a change of the object.
+var DefaultDrop = []string{"metadata.managedFields", "metadata.resourceVersion"}
+
+// DropPaths returns DefaultDrop followed by the paths of Drop.
+func (r Resource) DropPaths() []string {
+	return appendMissing(append([]string{}, DefaultDrop...), r.Drop...)
+}
+
+// IgnorePaths returns utils.DefaultIgnorePaths followed by the paths of
+// ChecksumIgnore, in the .field.subfield syntax sent to the server.
+func (r Resource) IgnorePaths() ([]string, error) {
+	paths := append([]string{}, utils.DefaultIgnorePaths...)
+	for _, path := range r.ChecksumIgnore {
+		ignorePath, err := utils.IgnorePath(path)
+		if err != nil {
+			return nil, err
+		}
+		paths = appendMissing(paths, ignorePath)
+	}
+	return paths, nil
+}
+
+// Validate checks the fetch mode, the namespaces and the paths of r.
+func (r Resource) Validate() error {
+	if r.FetchMode != "" && !r.FetchMode.IsValid() {
+		return fmt.Errorf("unknown fetch mode %q for %s", r.FetchMode, r.String())
+	}
+	if len(r.Namespaces) > 0 && len(r.ExcludeNamespaces) > 0 {
+		return fmt.Errorf("namespaces and excludeNamespaces are mutually exclusive for %s", r.String())
+	}
+	for _, path := range append(append([]string{}, r.Drop...), r.Redact...) {
+		_, err := utils.ParsePath(path)
+		if err != nil {
+			return fmt.Errorf("invalid path for %s: %w", r.String(), err)
+		}
+	}
+	_, err := r.IgnorePaths()
+	if err != nil {
+		return fmt.Errorf("invalid checksum ignore path for %s: %w", r.String(), err)
+	}
+	return nil
+}
+
+func appendMissing(paths []string, others ...string) []string {
+	for _, other := range others {
+		found := false
+		for _, path := range paths {
+			if path == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			paths = append(paths, other)
+		}
+	}
+	return paths
+}
+
+// FetchMode tells how complete objects are obtained, some aggregated APIs
+// return partial objects (e.g. with an empty spec) on list and watch.
+type FetchMode string
+
+const (
+	// FetchWatch uses the objects returned by list and watch, the default
+	FetchWatch FetchMode = "watch"
+	// FetchListThenGet gets each listed object, watch events carry complete objects
+	FetchListThenGet FetchMode = "listThenGet"
+	// FetchGetOnEvent gets each listed object, and the object of each watch event
+	FetchGetOnEvent FetchMode = "getOnEvent"
+)
+
+func (m FetchMode) IsValid() bool {
+	return m == FetchWatch || m == FetchListThenGet || m == FetchGetOnEvent
+}
+
+type ServerConfig struct {
+	Listen string      `mapstructure:"listen"`
+	TLS    TLSConfig   `mapstructure:"tls"`
+	Auth   AuthConfig  `mapstructure:"auth"`
+	Store  StoreConfig `mapstructure:"store"`
+	// ShutdownTimeout bounds the time spent closing connections on shutdown
+	ShutdownTimeout time.Duration     `mapstructure:"shutdownTimeout"`
+	Compression     CompressionConfig `mapstructure:"compression"`
+	// MetricsListen is the address serving the metrics on /debug/vars, disabled if empty,
+	// they are not authenticated and include the command line
+	MetricsListen string `mapstructure:"metricsListen"`
+}
+
+// AuthConfig lists the credentials allowed to connect to the server,
+// authentication is disabled if empty.
+type AuthConfig struct {
+	Credentials []Credential `mapstructure:"credentials"`
+}
+
+// Credential maps a bearer token or a client certificate common name
+// to the clusters it may synchronize.
+type Credential struct {
+	Token      string   `mapstructure:"token"`
+	CommonName string   `mapstructure:"commonName"`
+	Clusters   []string `mapstructure:"clusters"`
+}
+
+type StoreConfig struct {
+	// Type is either "memory" or "bolt"
+	Type          string            `mapstructure:"type"`
+	DataDir       string            `mapstructure:"dataDir"`
+	Fsync         store.FsyncPolicy `mapstructure:"fsync"`
+	FsyncInterval time.Duration     `mapstructure:"fsyncInterval"`
 }
 
 func (r Resource) String() string {
@@ -29,6 +213,16 @@ func LoadConfig(path string) (Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("json")
 
+	viper.SetDefault("server", "ws://127.0.0.1:8080/")
+	viper.SetDefault("shutdownTimeout", 10*time.Second)
+	viper.SetDefault("reconnect.initialInterval", time.Second)
+	viper.SetDefault("reconnect.maxInterval", time.Minute)
+	viper.SetDefault("ackTimeout", 10*time.Second)
+	viper.SetDefault("resyncPeriod", 10*time.Minute)
+	viper.SetDefault("fieldManager", "synchro")
+	viper.SetDefault("encoding", domain.EncodingJSON)
+	setCompressionDefaults()
+
 	viper.AutomaticEnv()
 
 	err := viper.ReadInConfig()
@@ -38,5 +232,63 @@ func LoadConfig(path string) (Config, error) {
 
 	var config Config
 	err = viper.Unmarshal(&config)
-	return config, err
+	if err != nil {
+		return Config{}, err
+	}
+	if config.Encoding != domain.EncodingJSON && config.Encoding != domain.EncodingCBOR {
+		return Config{}, fmt.Errorf("unknown encoding %q", config.Encoding)
+	}
+	err = config.Compression.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	for i, r := range config.Resources {
+		err := r.Validate()
+		if err != nil {
+			return Config{}, err
+		}
+		if r.FetchMode == "" {
+			config.Resources[i].FetchMode = FetchWatch
+		}
+	}
+	return config, nil
+}
+
+// LoadServerConfig reads the server configuration from file or environment variables.
+func LoadServerConfig(path string) (ServerConfig, error) {
+	viper.AddConfigPath(path)
+	viper.SetConfigName("server")
+	viper.SetConfigType("json")
+
+	viper.SetDefault("listen", ":8080")
+	viper.SetDefault("shutdownTimeout", 10*time.Second)
+	viper.SetDefault("store.type", "bolt")
+	viper.SetDefault("store.dataDir", "data")
+	viper.SetDefault("store.fsync", store.FsyncAlways)
+	viper.SetDefault("store.fsyncInterval", time.Second)
+	setCompressionDefaults()
+
+	viper.AutomaticEnv()
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+
+	var config ServerConfig
+	err = viper.Unmarshal(&config)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	err = config.Compression.Validate()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	return config, nil
+}
+
+func setCompressionDefaults() {
+	viper.SetDefault("compression.enabled", true)
+	viper.SetDefault("compression.threshold", domain.DefaultCompressionThreshold)
+	viper.SetDefault("compression.level", domain.DefaultCompressionLevel)
 }
@@ -0,0 +1,9 @@
+package domain
+
+// Ack represents a Ack model.
+type Ack struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Id                   string                 `json:"id,omitempty"`
+	Seq                  int                    `json:"seq,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -1,12 +1,12 @@
-
 package domain
 
 // Add represents a Add model.
 type Add struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  Object string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Object               string                 `json:"object,omitempty"`
+	OperationId          string                 `json:"operationId,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
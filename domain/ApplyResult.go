@@ -0,0 +1,14 @@
+package domain
+
+// ApplyResult represents a ApplyResult model.
+type ApplyResult struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Operation            *Event                 `json:"operation,omitempty"`
+	OperationId          string                 `json:"operationId,omitempty"`
+	Success              bool                   `json:"success,omitempty"`
+	Reason               string                 `json:"reason,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
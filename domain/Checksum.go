@@ -1,12 +1,11 @@
-
 package domain
 
 // Checksum represents a Checksum model.
 type Checksum struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  Checksum string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Checksum             string                 `json:"checksum,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
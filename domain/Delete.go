@@ -1,11 +1,11 @@
-
 package domain
 
 // Delete represents a Delete model.
 type Delete struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	OperationId          string                 `json:"operationId,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
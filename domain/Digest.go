@@ -0,0 +1,11 @@
+package domain
+
+// Digest represents a Digest model.
+type Digest struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Root                 string                 `json:"root,omitempty"`
+	Namespaces           map[string]string      `json:"namespaces,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
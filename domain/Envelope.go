@@ -0,0 +1,10 @@
+package domain
+
+// Envelope represents a Envelope model.
+type Envelope struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Id                   string                 `json:"id,omitempty"`
+	Seq                  int                    `json:"seq,omitempty"`
+	Message              string                 `json:"message,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
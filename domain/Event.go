@@ -1,16 +1,23 @@
-
 package domain
 
 // Event represents an enum of Event.
 type Event uint
 
 const (
-  EventAdd Event = iota
-  EventChecksum
-  EventDelete
-  EventPatch
-  EventRetrieve
-  EventUpdateShadow
+	EventAdd Event = iota
+	EventChecksum
+	EventDelete
+	EventPatch
+	EventRetrieve
+	EventUpdateShadow
+	EventInventory
+	EventDigest
+	EventRetrieveInventory
+	EventHello
+	EventHelloResponse
+	EventApplyResult
+	EventEnvelope
+	EventAck
 )
 
 // Value returns the value of the enum.
@@ -21,12 +28,20 @@ func (op Event) Value() any {
 	return EventValues[op]
 }
 
-var EventValues = []any{"add","checksum","delete","patch","retrieve","updateShadow"}
+var EventValues = []any{"add", "checksum", "delete", "patch", "retrieve", "updateShadow", "inventory", "digest", "retrieveInventory", "hello", "helloResponse", "applyResult", "envelope", "ack"}
 var ValuesToEvent = map[any]Event{
-  EventValues[EventAdd]: EventAdd,
-  EventValues[EventChecksum]: EventChecksum,
-  EventValues[EventDelete]: EventDelete,
-  EventValues[EventPatch]: EventPatch,
-  EventValues[EventRetrieve]: EventRetrieve,
-  EventValues[EventUpdateShadow]: EventUpdateShadow,
+	EventValues[EventAdd]:               EventAdd,
+	EventValues[EventChecksum]:          EventChecksum,
+	EventValues[EventDelete]:            EventDelete,
+	EventValues[EventPatch]:             EventPatch,
+	EventValues[EventRetrieve]:          EventRetrieve,
+	EventValues[EventUpdateShadow]:      EventUpdateShadow,
+	EventValues[EventInventory]:         EventInventory,
+	EventValues[EventDigest]:            EventDigest,
+	EventValues[EventRetrieveInventory]: EventRetrieveInventory,
+	EventValues[EventHello]:             EventHello,
+	EventValues[EventHelloResponse]:     EventHelloResponse,
+	EventValues[EventApplyResult]:       EventApplyResult,
+	EventValues[EventEnvelope]:          EventEnvelope,
+	EventValues[EventAck]:               EventAck,
 }
@@ -1,9 +1,9 @@
-
 package domain
 
 // Generic represents a Generic model.
 type Generic struct {
-  Event *Event
-  Kind *Kind
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
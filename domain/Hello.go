@@ -0,0 +1,13 @@
+package domain
+
+// Hello represents a Hello model.
+type Hello struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	ClientVersion        string                 `json:"clientVersion,omitempty"`
+	ProtocolVersion      int                    `json:"protocolVersion,omitempty"`
+	MinProtocolVersion   int                    `json:"minProtocolVersion,omitempty"`
+	Capabilities         []string               `json:"capabilities,omitempty"`
+	Resources            []Resource             `json:"resources,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -0,0 +1,12 @@
+package domain
+
+// HelloResponse represents a HelloResponse model.
+type HelloResponse struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Accepted             bool                   `json:"accepted,omitempty"`
+	Reason               string                 `json:"reason,omitempty"`
+	ServerVersion        string                 `json:"serverVersion,omitempty"`
+	ProtocolVersion      int                    `json:"protocolVersion,omitempty"`
+	Capabilities         []string               `json:"capabilities,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
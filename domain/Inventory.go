@@ -0,0 +1,11 @@
+package domain
+
+// Inventory represents a Inventory model.
+type Inventory struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Namespaces           []string               `json:"namespaces,omitempty"`
+	Checksums            map[string]string      `json:"checksums,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -1,10 +1,9 @@
-
 package domain
 
 // Kind represents a Kind model.
 type Kind struct {
-  Group string
-  Version string
-  Resource string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Group                string                 `json:"group,omitempty"`
+	Version              string                 `json:"version,omitempty"`
+	Resource             string                 `json:"resource,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -1,12 +1,11 @@
-
 package domain
 
 // Patch represents a Patch model.
 type Patch struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  Patch string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Patch                string                 `json:"patch,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -0,0 +1,9 @@
+package domain
+
+// Resource represents a Resource model.
+type Resource struct {
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Strategy             Strategy               `json:"strategy,omitempty"`
+	ChecksumIgnore       []string               `json:"checksumIgnore,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
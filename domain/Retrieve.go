@@ -1,11 +1,10 @@
-
 package domain
 
 // Retrieve represents a Retrieve model.
 type Retrieve struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
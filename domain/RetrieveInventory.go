@@ -0,0 +1,10 @@
+package domain
+
+// RetrieveInventory represents a RetrieveInventory model.
+type RetrieveInventory struct {
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Namespaces           []string               `json:"namespaces,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
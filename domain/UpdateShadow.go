@@ -1,12 +1,11 @@
-
 package domain
 
 // UpdateShadow represents a UpdateShadow model.
 type UpdateShadow struct {
-  Event *Event
-  Cluster string
-  Kind *Kind
-  Name string
-  Object string
-  AdditionalProperties map[string]interface{}
-}
\ No newline at end of file
+	Event                *Event                 `json:"event,omitempty"`
+	Cluster              string                 `json:"cluster,omitempty"`
+	Kind                 *Kind                  `json:"kind,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Object               string                 `json:"object,omitempty"`
+	AdditionalProperties map[string]interface{} `json:"-"`
+}
@@ -0,0 +1,349 @@
+package domain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Messages are encoded in CBOR with the field names of the spec, like in JSON,
+// but payloads holding JSON objects or encoded messages are byte strings,
+// neither escaped nor nested in a text string.
+var cborPayloads = map[string]bool{"object": true, "patch": true, "message": true}
+
+var cborEncMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{Sort: cbor.SortCoreDeterministic}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+var cborDecMode = func() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		DefaultMapType:     reflect.TypeOf(map[string]interface{}(nil)),
+		ByteStringToString: cbor.ByteStringToStringAllowed,
+		// inventories list all objects of a kind
+		MaxArrayElements: math.MaxInt32,
+		MaxMapPairs:      math.MaxInt32,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// MarshalCBOR encodes the event as its string value.
+func (op Event) MarshalCBOR() ([]byte, error) {
+	v := op.Value()
+	if v == nil {
+		return nil, fmt.Errorf("unknown event %d", op)
+	}
+	return cborEncMode.Marshal(v)
+}
+
+// UnmarshalCBOR decodes an event from its string value.
+func (op *Event) UnmarshalCBOR(data []byte) error {
+	var v string
+	err := cborDecMode.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	event, ok := ValuesToEvent[v]
+	if !ok {
+		return fmt.Errorf("unknown event %q", v)
+	}
+	*op = event
+	return nil
+}
+
+const (
+	cborByteString = 2
+	cborTextString = 3
+	cborMap        = 5
+)
+
+// appendCBORHead appends the head of a data item of major type with argument n.
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+}
+
+type cborField struct {
+	index     int
+	name      string
+	omitEmpty bool
+	payload   bool
+}
+
+var cborFieldCache sync.Map
+
+// cborFields returns the fields of a message type encoded in CBOR, named after their JSON tag.
+func cborFields(t reflect.Type) []cborField {
+	if fields, ok := cborFieldCache.Load(t); ok {
+		return fields.([]cborField)
+	}
+	var fields []cborField
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, cborField{
+			index:     i,
+			name:      name,
+			omitEmpty: opts == "omitempty",
+			payload:   cborPayloads[name] && t.Field(i).Type.Kind() == reflect.String,
+		})
+	}
+	cborFieldCache.Store(t, fields)
+	return fields
+}
+
+// isEmpty tells if a field is omitted, like encoding/json does with omitempty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// marshalCBORObject encodes v, a struct without methods, as a map in the order of
+// its fields followed by the additional properties not clashing with them.
+func marshalCBORObject(v interface{}, additional map[string]interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	var present []cborField
+	size := 16
+	for _, f := range cborFields(rv.Type()) {
+		if f.omitEmpty && isEmpty(rv.Field(f.index)) {
+			continue
+		}
+		present = append(present, f)
+		if f.payload {
+			size += rv.Field(f.index).Len() + 16
+		}
+	}
+	names := fieldNames(rv.Type())
+	var extra []string
+	for name := range additional {
+		if !names[strings.ToLower(name)] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	buf := appendCBORHead(make([]byte, 0, size), cborMap, uint64(len(present)+len(extra)))
+	for _, f := range present {
+		buf = appendCBORHead(buf, cborTextString, uint64(len(f.name)))
+		buf = append(buf, f.name...)
+		value := rv.Field(f.index)
+		if f.payload {
+			buf = appendCBORHead(buf, cborByteString, uint64(value.Len()))
+			buf = append(buf, value.String()...)
+			continue
+		}
+		data, err := cborEncMode.Marshal(value.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s: %w", f.name, err)
+		}
+		buf = append(buf, data...)
+	}
+	for _, name := range extra {
+		buf = appendCBORHead(buf, cborTextString, uint64(len(name)))
+		buf = append(buf, name...)
+		data, err := cborEncMode.Marshal(additional[name])
+		if err != nil {
+			return nil, fmt.Errorf("marshal additional property %s: %w", name, err)
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// unmarshalCBORObject decodes data into v, a pointer to a struct without methods, and
+// returns the properties not matching its fields.
+func unmarshalCBORObject(data []byte, v interface{}) (map[string]interface{}, error) {
+	var fields map[string]cbor.RawMessage
+	err := cborDecMode.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	known := cborFields(rv.Type())
+	var additional map[string]interface{}
+next:
+	for name, raw := range fields {
+		for _, f := range known {
+			if f.name == name {
+				err = cborDecMode.Unmarshal(raw, rv.Field(f.index).Addr().Interface())
+				if err != nil {
+					return nil, fmt.Errorf("unmarshal %s: %w", name, err)
+				}
+				continue next
+			}
+		}
+		var value interface{}
+		err = cborDecMode.Unmarshal(raw, &value)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal additional property %s: %w", name, err)
+		}
+		if additional == nil {
+			additional = map[string]interface{}{}
+		}
+		additional[name] = value
+	}
+	return additional, nil
+}
+
+func (m Ack) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Ack) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Add) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Add) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m ApplyResult) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *ApplyResult) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Checksum) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Checksum) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Delete) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Delete) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Digest) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Digest) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Envelope) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Envelope) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Generic) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Generic) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Hello) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Hello) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m HelloResponse) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *HelloResponse) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Inventory) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Inventory) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Kind) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Kind) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Patch) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Patch) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Resource) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Resource) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m Retrieve) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *Retrieve) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m RetrieveInventory) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *RetrieveInventory) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
+
+func (m UpdateShadow) MarshalCBOR() ([]byte, error) {
+	return marshalMessage(m, marshalCBORObject)
+}
+
+func (m *UpdateShadow) UnmarshalCBOR(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalCBORObject)
+}
@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Encodings of the messages following helloResponse, hello and helloResponse
+// are always encoded in JSON.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+	// EncodingBaseline is the JSON encoding of the clients predating hello
+	EncodingBaseline = "json-baseline"
+)
+
+// Codec encodes and decodes the messages of a session.
+type Codec interface {
+	// Name identifies the encoding, messages encoded by codecs of different names are not compatible.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// NewCodec returns the codec of a session, CBOR if both sides advertised it.
+func NewCodec(protocolVersion int, capabilities []string) Codec {
+	if protocolVersion == BaselineProtocolVersion {
+		return baselineCodec{}
+	}
+	for _, c := range capabilities {
+		if c == CapabilityCBOR {
+			return cborCodec{}
+		}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return EncodingJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// baselineCodec encodes messages like the clients predating hello, their
+// messages are decoded like the ones of the current revision.
+type baselineCodec struct {
+	jsonCodec
+}
+
+func (baselineCodec) Name() string {
+	return EncodingBaseline
+}
+
+func (baselineCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(baseline(reflect.ValueOf(v)))
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return EncodingCBOR
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(data, v)
+}
@@ -0,0 +1,177 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCodec(t *testing.T) {
+	assert.Equal(t, EncodingJSON, NewCodec(ProtocolVersion, Capabilities).Name())
+	assert.Equal(t, EncodingBaseline, NewCodec(BaselineProtocolVersion, []string{CapabilityCBOR}).Name())
+	assert.Equal(t, EncodingCBOR, NewCodec(ProtocolVersion, []string{CapabilityDigest, CapabilityCBOR}).Name())
+}
+
+// TestCBORMessages checks that messages are encoded in CBOR like in the golden
+// JSON files, with payloads as byte strings.
+func TestCBORMessages(t *testing.T) {
+	codec := NewCodec(ProtocolVersion, []string{CapabilityCBOR})
+	for name, msg := range messages {
+		name, msg := name, msg
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Marshal(msg)
+			require.NoError(t, err)
+			again, err := codec.Marshal(msg)
+			require.NoError(t, err)
+			assert.Equal(t, data, again, "encoding is not deterministic")
+
+			golden, err := os.ReadFile(filepath.Join("testdata", name+".json"))
+			require.NoError(t, err)
+			var expected interface{}
+			require.NoError(t, json.Unmarshal(golden, &expected))
+			var value interface{}
+			require.NoError(t, cborDecMode.Unmarshal(data, &value))
+			assert.Equal(t, expected, fromCBOR(t, value))
+
+			decoded := reflect.New(reflect.TypeOf(msg))
+			require.NoError(t, codec.Unmarshal(data, decoded.Interface()))
+			assert.Equal(t, msg, decoded.Elem().Interface())
+		})
+	}
+}
+
+// fromCBOR converts a decoded CBOR value to the value decoded from the same
+// message in JSON, payloads must be byte strings.
+func fromCBOR(t *testing.T, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			if cborPayloads[name] {
+				payload, ok := field.([]byte)
+				assert.True(t, ok, "%s is not a byte string", name)
+				converted[name] = string(payload)
+				continue
+			}
+			converted[name] = fromCBOR(t, field)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = fromCBOR(t, item)
+		}
+		return converted
+	case uint64:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+func TestCBORAdditionalProperties(t *testing.T) {
+	codec := NewCodec(ProtocolVersion, []string{CapabilityCBOR})
+	add := Add{Event: eventPtr(EventAdd), Cluster: "cluster-a", Name: "default/nginx",
+		Kind:                 &Kind{Version: "v1", Resource: "pods", AdditionalProperties: map[string]interface{}{"subresource": "status"}},
+		AdditionalProperties: map[string]interface{}{"priority": uint64(5), "name": "other"},
+	}
+	data, err := codec.Marshal(add)
+	require.NoError(t, err)
+	var decoded Add
+	require.NoError(t, codec.Unmarshal(data, &decoded))
+	assert.Equal(t, "default/nginx", decoded.Name)
+	assert.Equal(t, map[string]interface{}{"priority": uint64(5)}, decoded.AdditionalProperties)
+	assert.Equal(t, map[string]interface{}{"subresource": "status"}, decoded.Kind.AdditionalProperties)
+}
+
+func TestCBOREnvelope(t *testing.T) {
+	codec := NewCodec(ProtocolVersion, []string{CapabilityCBOR})
+	object := `{"metadata":{"name":"nginx","annotations":{"note":"\"quoted\""}}}`
+	message, err := codec.Marshal(Add{Event: eventPtr(EventAdd), Name: "default/nginx", Object: object})
+	require.NoError(t, err)
+	data, err := codec.Marshal(Envelope{Event: eventPtr(EventEnvelope), Id: "1", Seq: 1, Message: string(message)})
+	require.NoError(t, err)
+	// the object is neither escaped in the message nor in the envelope
+	assert.True(t, bytes.Contains(data, []byte(object)))
+
+	var envelope Envelope
+	require.NoError(t, codec.Unmarshal(data, &envelope))
+	var add Add
+	require.NoError(t, codec.Unmarshal([]byte(envelope.Message), &add))
+	assert.Equal(t, object, add.Object)
+
+	var event Event
+	assert.Error(t, codec.Unmarshal([]byte{0x63, 'f', 'o', 'o'}, &event))
+}
+
+// sbom returns a JSON object of about size bytes, shaped like the SBOMs synchronized.
+func sbom(size int) string {
+	var packages []string
+	for i := 0; len(strings.Join(packages, ",")) < size; i++ {
+		packages = append(packages, fmt.Sprintf(`{"name":"package-%d","SPDXID":"SPDXRef-Package-%d","versionInfo":"1.%d.0","downloadLocation":"NOASSERTION","licenseConcluded":"NOASSERTION","externalRefs":[{"referenceCategory":"PACKAGE-MANAGER","referenceType":"purl","referenceLocator":"pkg:golang/example.com/package-%d@v1.%d.0"}]}`, i, i, i, i, i))
+	}
+	return `{"apiVersion":"spdx.softwarecomposition.kubescape.io/v1beta1","kind":"SBOMSPDXv2p3","spec":{"spdx":{"packages":[` + strings.Join(packages, ",") + `]}}}`
+}
+
+// BenchmarkCodecs compares the encodings of an add message wrapped in an
+// envelope, as sent on the wire.
+func BenchmarkCodecs(b *testing.B) {
+	codecs := []Codec{
+		NewCodec(ProtocolVersion, nil),
+		NewCodec(ProtocolVersion, []string{CapabilityCBOR}),
+	}
+	for _, size := range []int{1 << 10, 1 << 20} {
+		add := Add{Event: eventPtr(EventAdd), Cluster: "cluster-a", Kind: &Kind{Group: "spdx.softwarecomposition.kubescape.io", Version: "v1beta1", Resource: "sbomspdxv2p3s"},
+			Name: "kubescape/replicaset-nginx-6f5b8d9c7", Object: sbom(size)}
+		for _, codec := range codecs {
+			codec := codec
+			encode := func() []byte {
+				message, err := codec.Marshal(add)
+				if err != nil {
+					b.Fatal(err)
+				}
+				data, err := codec.Marshal(Envelope{Event: eventPtr(EventEnvelope), Id: "1", Seq: 1, Message: string(message)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				return data
+			}
+			data := encode()
+			name := fmt.Sprintf("%s/%dKiB", codec.Name(), size>>10)
+			b.Run(name+"/marshal", func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(add.Object)))
+				for i := 0; i < b.N; i++ {
+					encode()
+				}
+				b.ReportMetric(float64(len(data))/float64(len(add.Object)), "wire/object")
+			})
+			b.Run(name+"/unmarshal", func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(add.Object)))
+				for i := 0; i < b.N; i++ {
+					var envelope Envelope
+					err := codec.Unmarshal(data, &envelope)
+					if err != nil {
+						b.Fatal(err)
+					}
+					var decoded Add
+					err = codec.Unmarshal([]byte(envelope.Message), &decoded)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data))/float64(len(add.Object)), "wire/object")
+			})
+		}
+	}
+}
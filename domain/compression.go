@@ -0,0 +1,186 @@
+package domain
+
+import (
+	"bytes"
+	"embed"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultCompressionThreshold is the size from which messages are compressed,
+	// smaller ones gain little even with a dictionary and are sent as is.
+	DefaultCompressionThreshold = 128
+	// DefaultCompressionLevel is the zstd level messages are compressed with.
+	DefaultCompressionLevel = 3
+	// maxDecompressedSize bounds the memory used to decompress a message.
+	maxDecompressedSize = 256 << 20
+)
+
+// zstdMagic starts every zstd frame, JSON and CBOR messages never start with it.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// dictionaryFiles holds the raw zstd dictionaries, made of typical messages in
+// both encodings and built by TestDictionaryCorpus from testdata/dictionary. A
+// dictionary never changes once released, a new one gets the next id so that
+// peers negotiate the most recent dictionary they share.
+//
+//go:embed dictionaries
+var dictionaryFiles embed.FS
+
+// dictionaries are the known zstd dictionaries by id, ids start at 32768 as the
+// lower ones are reserved by the zstd format.
+var dictionaries = map[uint32][]byte{
+	32768: mustReadDictionary("dictionaries/zstd-1"),
+}
+
+func mustReadDictionary(name string) []byte {
+	content, err := dictionaryFiles.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	return content
+}
+
+// DictionaryCapability advertises the zstd dictionary of id, along with CapabilityZstd.
+func DictionaryCapability(id uint32) string {
+	return CapabilityZstd + ".dict." + strconv.FormatUint(uint64(id), 10)
+}
+
+// CompressionCapabilities are the capabilities advertised when compression is
+// enabled: zstd, and zstd with each known dictionary.
+func CompressionCapabilities() []string {
+	ids := make([]uint32, 0, len(dictionaries))
+	for id := range dictionaries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	capabilities := []string{CapabilityZstd}
+	for _, id := range ids {
+		capabilities = append(capabilities, DictionaryCapability(id))
+	}
+	return capabilities
+}
+
+// IsCompressionCapability tells if c is advertised by CompressionCapabilities.
+func IsCompressionCapability(c string) bool {
+	return c == CapabilityZstd || strings.HasPrefix(c, CapabilityZstd+".dict.")
+}
+
+// NegotiatedDictionary returns the id of the most recent known dictionary in
+// capabilities, 0 if none.
+func NegotiatedDictionary(capabilities []string) uint32 {
+	var negotiated uint32
+	for _, c := range capabilities {
+		for id := range dictionaries {
+			if c == DictionaryCapability(id) && id > negotiated {
+				negotiated = id
+			}
+		}
+	}
+	return negotiated
+}
+
+// CompressionMetrics counts the messages compressed and decompressed by the
+// process, published by expvar:
+//
+//	compressed, compressedBytes, uncompressedBytes, savedBytes: messages sent compressed
+//	incompressible: messages larger than the threshold sent as is, as compressing them does not help
+//	decompressed, decompressedBytes: messages received compressed
+var CompressionMetrics = expvar.NewMap("compression")
+
+// Compressor compresses the messages larger than a threshold with zstd, it is
+// safe for concurrent use. A nil Compressor does not compress.
+type Compressor struct {
+	threshold int
+	encoder   *zstd.Encoder
+	// withDictionaries are the compressors using the known dictionaries, by id
+	withDictionaries map[uint32]*Compressor
+}
+
+// NewCompressor returns a compressor of the messages of at least threshold
+// bytes, level is a zstd level from 1 (fastest) to 22 (smallest).
+func NewCompressor(threshold, level int) (*Compressor, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, fmt.Errorf("create zstd encoder: %w", err)
+	}
+	c := &Compressor{
+		threshold:        threshold,
+		encoder:          encoder,
+		withDictionaries: map[uint32]*Compressor{},
+	}
+	for id, content := range dictionaries {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderDictRaw(id, content))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd encoder with dictionary %d: %w", id, err)
+		}
+		c.withDictionaries[id] = &Compressor{
+			threshold: threshold,
+			encoder:   encoder,
+		}
+	}
+	return c, nil
+}
+
+// WithDictionary returns the compressor using the dictionary of id, or c if
+// the dictionary is unknown, e.g. 0 when none was negotiated.
+func (c *Compressor) WithDictionary(id uint32) *Compressor {
+	if c == nil {
+		return nil
+	}
+	if d, ok := c.withDictionaries[id]; ok {
+		return d
+	}
+	return c
+}
+
+// Compress returns data compressed in a zstd frame, or data if it is smaller
+// than the threshold or does not compress.
+func (c *Compressor) Compress(data []byte) []byte {
+	if c == nil || len(data) < c.threshold {
+		return data
+	}
+	compressed := c.encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if len(compressed) >= len(data) {
+		CompressionMetrics.Add("incompressible", 1)
+		return data
+	}
+	CompressionMetrics.Add("compressed", 1)
+	CompressionMetrics.Add("uncompressedBytes", int64(len(data)))
+	CompressionMetrics.Add("compressedBytes", int64(len(compressed)))
+	CompressionMetrics.Add("savedBytes", int64(len(data)-len(compressed)))
+	return compressed
+}
+
+// decoder decompresses messages compressed with any known dictionary, or none.
+var decoder = func() *zstd.Decoder {
+	options := []zstd.DOption{zstd.WithDecoderMaxMemory(maxDecompressedSize)}
+	for id, content := range dictionaries {
+		options = append(options, zstd.WithDecoderDictRaw(id, content))
+	}
+	d, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}()
+
+// Decompress returns the message held by data, decompressed if it is a zstd frame.
+func Decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, zstdMagic) {
+		return data, nil
+	}
+	message, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompress message: %w", err)
+	}
+	CompressionMetrics.Add("decompressed", 1)
+	CompressionMetrics.Add("decompressedBytes", int64(len(message)))
+	return message, nil
+}
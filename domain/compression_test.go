@@ -0,0 +1,160 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metric(name string) int64 {
+	if v, ok := CompressionMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCompressor(t *testing.T) {
+	c, err := NewCompressor(DefaultCompressionThreshold, DefaultCompressionLevel)
+	require.NoError(t, err)
+
+	// small messages are sent as is
+	small := []byte(`{"event":"ack","id":"1","seq":1}`)
+	assert.Equal(t, small, c.Compress(small))
+
+	saved := metric("savedBytes")
+	message := []byte(sbom(1 << 20))
+	compressed := c.Compress(message)
+	assert.True(t, bytes.HasPrefix(compressed, zstdMagic))
+	assert.Less(t, len(compressed), len(message)/4)
+	assert.Equal(t, int64(len(message)-len(compressed)), metric("savedBytes")-saved)
+	decompressed, err := Decompress(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, message, decompressed)
+
+	// random data does not compress
+	random := make([]byte, 4096)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	assert.Equal(t, random, c.Compress(random))
+
+	var nilCompressor *Compressor
+	assert.Equal(t, message, nilCompressor.Compress(message))
+}
+
+func TestDecompress(t *testing.T) {
+	// uncompressed messages are returned as is, in both encodings
+	for _, msg := range []interface{}{messages["add"], messages["envelope"]} {
+		for _, codec := range []Codec{NewCodec(ProtocolVersion, nil), NewCodec(ProtocolVersion, []string{CapabilityCBOR})} {
+			data, err := codec.Marshal(msg)
+			require.NoError(t, err)
+			decompressed, err := Decompress(data)
+			require.NoError(t, err)
+			assert.Equal(t, data, decompressed)
+		}
+	}
+	_, err := Decompress(append(append([]byte{}, zstdMagic...), "garbage"...))
+	assert.Error(t, err)
+}
+
+func TestDictionary(t *testing.T) {
+	assert.Equal(t, []string{CapabilityZstd, "compression.zstd.dict.32768"}, CompressionCapabilities())
+	assert.True(t, IsCompressionCapability("compression.zstd.dict.32768"))
+	assert.False(t, IsCompressionCapability(CapabilityCBOR))
+	assert.Equal(t, uint32(32768), NegotiatedDictionary(IntersectCapabilities(CompressionCapabilities(), CompressionCapabilities())))
+	assert.Zero(t, NegotiatedDictionary([]string{CapabilityZstd, DictionaryCapability(1)}))
+
+	c, err := NewCompressor(DefaultCompressionThreshold, DefaultCompressionLevel)
+	require.NoError(t, err)
+	assert.Same(t, c, c.WithDictionary(0))
+	d := c.WithDictionary(32768)
+	assert.NotSame(t, c, d)
+	var nilCompressor *Compressor
+	assert.Nil(t, nilCompressor.WithDictionary(32768))
+
+	// small messages compress well with the dictionary only
+	for _, codec := range []Codec{NewCodec(ProtocolVersion, nil), NewCodec(ProtocolVersion, []string{CapabilityCBOR})} {
+		message, err := codec.Marshal(messages["add"])
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, len(message), DefaultCompressionThreshold, codec.Name())
+		compressed := d.Compress(message)
+		assert.Less(t, len(compressed), len(message)*6/10, codec.Name())
+		assert.Less(t, len(compressed), len(c.Compress(message)), codec.Name())
+		decompressed, err := Decompress(compressed)
+		require.NoError(t, err)
+		assert.Equal(t, message, decompressed)
+	}
+}
+
+// dictionaryCorpus builds the raw zstd dictionary of typical messages: the messages
+// of each type, holding the sample objects of testdata/dictionary, wrapped in envelopes
+// in CBOR then JSON. They are ordered from the least to the most frequent, as the end
+// of a raw dictionary is the cheapest to reference.
+func dictionaryCorpus(t *testing.T) []byte {
+	sample := func(name string) string {
+		data, err := os.ReadFile(filepath.Join("testdata", "dictionary", name+".json"))
+		require.NoError(t, err)
+		return string(bytes.TrimSpace(data))
+	}
+	deployment, pod, sbom := sample("deployment"), sample("pod"), sample("sbomspdxv2p3")
+	deployments := &Kind{Group: "apps", Version: "v1", Resource: "deployments"}
+	pods := &Kind{Version: "v1", Resource: "pods"}
+	sboms := &Kind{Group: "spdx.softwarecomposition.kubescape.io", Version: "v1beta1", Resource: "sbomspdxv2p3s"}
+	checksum := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	// values are literals, the dictionary must not change with the constants
+	msgs := []interface{}{
+		Hello{Event: eventPtr(EventHello), Cluster: "cluster", ClientVersion: "v0.0.0", ProtocolVersion: 1, MinProtocolVersion: 1,
+			Capabilities: []string{"apply", "digest", "patch.merge", "encoding.cbor", "compression.zstd"},
+			Resources: []Resource{{Kind: deployments, Strategy: PatchStrategy,
+				ChecksumIgnore: []string{".metadata.resourceVersion", ".metadata.generation", ".metadata.managedFields", ".status"}}}},
+		Add{Event: eventPtr(EventAdd), Cluster: "cluster", Kind: sboms, Name: "kubescape/replicaset-nginx-7c5ddbdf54", Object: sbom},
+		Add{Event: eventPtr(EventAdd), Cluster: "cluster", Kind: pods, Name: "default/nginx-7c5ddbdf54-abcde", Object: pod},
+		Add{Event: eventPtr(EventAdd), Cluster: "cluster", Kind: deployments, Name: "default/nginx", Object: deployment},
+		UpdateShadow{Event: eventPtr(EventUpdateShadow), Cluster: "cluster", Kind: deployments, Name: "default/nginx", Object: deployment},
+		Digest{Event: eventPtr(EventDigest), Cluster: "cluster", Kind: deployments, Root: checksum,
+			Namespaces: map[string]string{"default": checksum, "kube-system": checksum}},
+		Inventory{Event: eventPtr(EventInventory), Cluster: "cluster", Kind: deployments, Namespaces: []string{"default"},
+			Checksums: map[string]string{"default/nginx": checksum}},
+		RetrieveInventory{Event: eventPtr(EventRetrieveInventory), Cluster: "cluster", Kind: deployments, Namespaces: []string{"default", "kube-system"}},
+		ApplyResult{Event: eventPtr(EventApplyResult), Cluster: "cluster", Kind: deployments, Name: "default/nginx", Operation: eventPtr(EventAdd), Success: true},
+		Delete{Event: eventPtr(EventDelete), Cluster: "cluster", Kind: pods, Name: "default/nginx-7c5ddbdf54-abcde"},
+		Patch{Event: eventPtr(EventPatch), Cluster: "cluster", Kind: pods, Name: "default/nginx-7c5ddbdf54-abcde",
+			Patch: `{"metadata":{"labels":{"app":"nginx"}},"status":{"conditions":[{"lastTransitionTime":"2024-01-01T00:00:00Z","status":"True","type":"Ready"}]}}`},
+		Retrieve{Event: eventPtr(EventRetrieve), Cluster: "cluster", Kind: pods, Name: "default/nginx-7c5ddbdf54-abcde"},
+		Checksum{Event: eventPtr(EventChecksum), Cluster: "cluster", Kind: deployments, Name: "default/nginx", Checksum: checksum},
+		Checksum{Event: eventPtr(EventChecksum), Cluster: "cluster", Kind: pods, Name: "default/nginx-7c5ddbdf54-abcde", Checksum: checksum},
+	}
+	var buf bytes.Buffer
+	for _, codec := range []Codec{cborCodec{}, jsonCodec{}} {
+		for _, msg := range msgs {
+			data, err := codec.Marshal(msg)
+			require.NoError(t, err)
+			data, err = codec.Marshal(Envelope{Event: eventPtr(EventEnvelope), Id: "1", Seq: 1, Message: string(data)})
+			require.NoError(t, err)
+			buf.Write(data)
+		}
+		data, err := codec.Marshal(Ack{Event: eventPtr(EventAck), Id: "1", Seq: 1})
+		require.NoError(t, err)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// TestDictionaryCorpus checks that the dictionary is built from its corpus, it is
+// written with -update. Released dictionaries never change: if the encoding of the
+// messages changes, a new dictionary is added instead.
+func TestDictionaryCorpus(t *testing.T) {
+	corpus := dictionaryCorpus(t)
+	file := filepath.Join("dictionaries", "zstd-1")
+	if *update {
+		require.NoError(t, os.WriteFile(file, corpus, 0644))
+	}
+	dictionary, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, dictionary, corpus)
+}
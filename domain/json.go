@@ -0,0 +1,346 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Messages are encoded as described in api/asyncapi.yaml: events as strings,
+// fields in lowerCamelCase and unknown fields kept in AdditionalProperties.
+// Clients predating hello name the fields after the Go fields and encode events
+// as integers, both are still decoded.
+
+// MarshalJSON encodes the event as its string value.
+func (op Event) MarshalJSON() ([]byte, error) {
+	v := op.Value()
+	if v == nil {
+		return nil, fmt.Errorf("unknown event %d", op)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes an event from its string value, or from its index
+// sent by clients predating hello.
+func (op *Event) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		event, ok := ValuesToEvent[v]
+		if !ok {
+			return fmt.Errorf("unknown event %q", v)
+		}
+		*op = event
+	case float64:
+		if v < 0 || v >= float64(len(EventValues)) || v != math.Trunc(v) {
+			return fmt.Errorf("unknown event %v", v)
+		}
+		*op = Event(v)
+	default:
+		return fmt.Errorf("invalid event %s", data)
+	}
+	return nil
+}
+
+var eventType = reflect.TypeOf(Event(0))
+
+// baseline converts v to the format of the clients predating hello.
+func baseline(v reflect.Value) interface{} {
+	if v.Type() == eventType {
+		return v.Uint()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return baseline(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				fields[f.Name] = baseline(v.Field(i))
+			}
+		}
+		return fields
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = baseline(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[fmt.Sprint(iter.Key().Interface())] = baseline(iter.Value())
+		}
+		return entries
+	}
+	return v.Interface()
+}
+
+// knownFields caches the lowercased names of the fields of each message type.
+var knownFields sync.Map
+
+// fieldNames returns the names a field of t can be decoded from, lowercased
+// as encoding/json matches them case-insensitively.
+func fieldNames(t reflect.Type) map[string]bool {
+	if names, ok := knownFields.Load(t); ok {
+		return names.(map[string]bool)
+	}
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		names[strings.ToLower(f.Name)] = true
+		if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag != "" && tag != "-" {
+			names[strings.ToLower(tag)] = true
+		}
+	}
+	knownFields.Store(t, names)
+	return names
+}
+
+// marshalObject encodes v, a struct without methods, with the additional properties
+// not clashing with its fields.
+func marshalObject(v interface{}, additional map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(additional) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	names := fieldNames(reflect.TypeOf(v))
+	for name, value := range additional {
+		if names[strings.ToLower(name)] {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("marshal additional property %s: %w", name, err)
+		}
+		fields[name] = raw
+	}
+	return json.Marshal(fields)
+}
+
+// unmarshalObject decodes data into v, a pointer to a struct without methods, and
+// returns the properties not matching its fields.
+func unmarshalObject(data []byte, v interface{}) (map[string]interface{}, error) {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	names := fieldNames(reflect.TypeOf(v).Elem())
+	var additional map[string]interface{}
+	for name, raw := range fields {
+		if names[strings.ToLower(name)] {
+			continue
+		}
+		var value interface{}
+		err = json.Unmarshal(raw, &value)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal additional property %s: %w", name, err)
+		}
+		if additional == nil {
+			additional = map[string]interface{}{}
+		}
+		additional[name] = value
+	}
+	return additional, nil
+}
+
+// plainTypes caches the struct types of the messages without their methods.
+var plainTypes sync.Map
+
+// plainType returns a struct type with the fields and tags of the message type t
+// but none of its methods, so that encoding it does not recurse into them.
+func plainType(t reflect.Type) reflect.Type {
+	if p, ok := plainTypes.Load(t); ok {
+		return p.(reflect.Type)
+	}
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+	}
+	p := reflect.StructOf(fields)
+	plainTypes.Store(t, p)
+	return p
+}
+
+// marshalMessage encodes m, a message with AdditionalProperties, with encode.
+func marshalMessage[T any](m T, encode func(v interface{}, additional map[string]interface{}) ([]byte, error)) ([]byte, error) {
+	v := reflect.ValueOf(m)
+	additional := v.FieldByName("AdditionalProperties").Interface().(map[string]interface{})
+	return encode(v.Convert(plainType(v.Type())).Interface(), additional)
+}
+
+// unmarshalMessage decodes data into m, a message with AdditionalProperties, with decode.
+func unmarshalMessage[T any](data []byte, m *T, decode func(data []byte, v interface{}) (map[string]interface{}, error)) error {
+	v := reflect.ValueOf(m).Elem()
+	p := reflect.New(plainType(v.Type()))
+	additional, err := decode(data, p.Interface())
+	if err != nil {
+		return err
+	}
+	v.Set(p.Elem().Convert(v.Type()))
+	v.FieldByName("AdditionalProperties").Set(reflect.ValueOf(additional))
+	return nil
+}
+
+func (m Ack) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Ack) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Add) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Add) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m ApplyResult) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *ApplyResult) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Checksum) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Checksum) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Delete) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Delete) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Digest) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Digest) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Envelope) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Envelope) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Generic) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Generic) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Hello) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Hello) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m HelloResponse) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *HelloResponse) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Inventory) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Inventory) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Kind) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Kind) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Patch) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Patch) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Resource) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Resource) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m Retrieve) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *Retrieve) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m RetrieveInventory) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *RetrieveInventory) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
+
+func (m UpdateShadow) MarshalJSON() ([]byte, error) {
+	return marshalMessage(m, marshalObject)
+}
+
+func (m *UpdateShadow) UnmarshalJSON(data []byte) error {
+	return unmarshalMessage(data, m, unmarshalObject)
+}
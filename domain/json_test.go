@@ -0,0 +1,257 @@
+package domain
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func eventPtr(e Event) *Event {
+	return &e
+}
+
+var deployments = &Kind{Group: "apps", Version: "v1", Resource: "deployments"}
+
+// messages has a message of each type with all fields set, named after their schema.
+var messages = map[string]interface{}{
+	"ack": Ack{Event: eventPtr(EventAck), Id: "42", Seq: 7},
+	"add": Add{Event: eventPtr(EventAdd), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx",
+		Object: `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"nginx","namespace":"default"}}`},
+	"applyResult": ApplyResult{Event: eventPtr(EventApplyResult), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx",
+		Operation: eventPtr(EventDelete), Success: true, Reason: "not found"},
+	"checksum": Checksum{Event: eventPtr(EventChecksum), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx", Checksum: "a1b2c3"},
+	"delete":   Delete{Event: eventPtr(EventDelete), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx"},
+	"digest": Digest{Event: eventPtr(EventDigest), Cluster: "cluster-a", Kind: deployments, Root: "d4e5f6",
+		Namespaces: map[string]string{"default": "a1b2c3", "kube-system": "d4e5f6"}},
+	"envelope": Envelope{Event: eventPtr(EventEnvelope), Id: "42", Seq: 7, Message: `{"event":"delete","cluster":"cluster-a"}`},
+	"generic":  Generic{Event: eventPtr(EventRetrieve), Cluster: "cluster-a", Kind: deployments},
+	"hello": Hello{Event: eventPtr(EventHello), Cluster: "cluster-a", ClientVersion: "v1.2.3", ProtocolVersion: 1,
+		MinProtocolVersion: 1, Capabilities: []string{"apply", "digest", "patch.merge"}, Resources: []Resource{
+			{Kind: deployments, Strategy: PatchStrategy, ChecksumIgnore: []string{".metadata.resourceVersion"}},
+			{Kind: &Kind{Version: "v1", Resource: "pods"}, Strategy: CopyStrategy},
+		}},
+	"helloResponse": HelloResponse{Event: eventPtr(EventHelloResponse), Accepted: true, Reason: "welcome",
+		ServerVersion: "v1.2.3", ProtocolVersion: 1, Capabilities: []string{"apply", "patch.merge"}},
+	"inventory": Inventory{Event: eventPtr(EventInventory), Cluster: "cluster-a", Kind: deployments, Namespaces: []string{"default"},
+		Checksums: map[string]string{"default/nginx": "a1b2c3", "default/redis": "d4e5f6"}},
+	"patch": Patch{Event: eventPtr(EventPatch), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx",
+		Patch: `{"spec":{"replicas":3}}`},
+	"retrieve": Retrieve{Event: eventPtr(EventRetrieve), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx"},
+	"retrieveInventory": RetrieveInventory{Event: eventPtr(EventRetrieveInventory), Cluster: "cluster-a", Kind: deployments,
+		Namespaces: []string{"default", "kube-system"}},
+	"updateShadow": UpdateShadow{Event: eventPtr(EventUpdateShadow), Cluster: "cluster-a", Kind: deployments, Name: "default/nginx",
+		Object: `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"nginx","namespace":"default"}}`},
+}
+
+func TestGoldenMessages(t *testing.T) {
+	schemas := loadSchemas(t)
+	for name, msg := range messages {
+		name, msg := name, msg
+		t.Run(name, func(t *testing.T) {
+			data, err := json.MarshalIndent(msg, "", "  ")
+			require.NoError(t, err)
+			golden := filepath.Join("testdata", name+".json")
+			if *update {
+				require.NoError(t, os.WriteFile(golden, append(data, '\n'), 0644))
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), string(data)+"\n")
+
+			var value interface{}
+			require.NoError(t, json.Unmarshal(expected, &value))
+			assert.Empty(t, schemas.validate(name, map[string]interface{}{"$ref": "#/components/schemas/" + name}, value, true))
+
+			decoded := reflect.New(reflect.TypeOf(msg))
+			require.NoError(t, json.Unmarshal(expected, decoded.Interface()))
+			assert.Equal(t, msg, decoded.Elem().Interface())
+		})
+	}
+}
+
+// TestModelsMatchSpec checks that the fields of the message types, maintained by
+// hand, are the properties of their schema in the spec.
+func TestModelsMatchSpec(t *testing.T) {
+	schemas := loadSchemas(t)
+	types := map[string]reflect.Type{"kind": reflect.TypeOf(Kind{}), "resource": reflect.TypeOf(Resource{})}
+	for name, msg := range messages {
+		types[name] = reflect.TypeOf(msg)
+	}
+	for name, typ := range types {
+		schema, ok := schemas[name].(map[string]interface{})
+		require.True(t, ok, name)
+		var properties []string
+		for property := range schema["properties"].(map[string]interface{}) {
+			properties = append(properties, property)
+		}
+		var fields []string
+		for i := 0; i < typ.NumField(); i++ {
+			if tag, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ","); tag != "-" {
+				fields = append(fields, tag)
+			}
+		}
+		assert.ElementsMatch(t, properties, fields, name)
+	}
+}
+
+func TestAdditionalProperties(t *testing.T) {
+	data := `{"event":"add","cluster":"cluster-a","kind":{"group":"apps","version":"v1","resource":"deployments","subresource":"status"},"name":"default/nginx","priority":5,"trace":{"id":"abc"}}`
+	var add Add
+	require.NoError(t, json.Unmarshal([]byte(data), &add))
+	assert.Equal(t, map[string]interface{}{"priority": float64(5), "trace": map[string]interface{}{"id": "abc"}}, add.AdditionalProperties)
+	assert.Equal(t, map[string]interface{}{"subresource": "status"}, add.Kind.AdditionalProperties)
+	assert.Equal(t, "default/nginx", add.Name)
+
+	out, err := json.Marshal(add)
+	require.NoError(t, err)
+	assert.JSONEq(t, data, string(out))
+	var value interface{}
+	require.NoError(t, json.Unmarshal(out, &value))
+	schema := map[string]interface{}{"$ref": "#/components/schemas/add"}
+	assert.Empty(t, loadSchemas(t).validate("add", schema, value, false))
+	// priority, trace and kind.subresource
+	assert.Len(t, loadSchemas(t).validate("add", schema, value, true), 3)
+
+	// additional properties do not override fields
+	add.AdditionalProperties["name"] = "other"
+	out, err = json.Marshal(add)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"name":"default/nginx"`)
+	assert.NotContains(t, string(out), "other")
+}
+
+func TestEventJSON(t *testing.T) {
+	for i := range EventValues {
+		event := Event(i)
+		data, err := json.Marshal(event)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%q", EventValues[i]), string(data))
+		var decoded Event
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, event, decoded)
+	}
+	_, err := json.Marshal(Event(len(EventValues)))
+	assert.Error(t, err)
+	for _, data := range []string{`"unknown"`, `-1`, `1.5`, `99`, `true`} {
+		var event Event
+		assert.Error(t, json.Unmarshal([]byte(data), &event), data)
+	}
+}
+
+// TestBaselineFormat checks that the messages known to the clients predating
+// hello are encoded and decoded like they do.
+func TestBaselineFormat(t *testing.T) {
+	codec := NewCodec(BaselineProtocolVersion, nil)
+	for _, name := range []string{"add", "checksum", "delete", "patch", "retrieve", "updateShadow"} {
+		msg := messages[name]
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Marshal(msg)
+			require.NoError(t, err)
+			var fields map[string]interface{}
+			require.NoError(t, json.Unmarshal(data, &fields))
+			assert.IsType(t, float64(0), fields["Event"])
+			assert.NotContains(t, fields, "event")
+			decoded := reflect.New(reflect.TypeOf(msg))
+			require.NoError(t, codec.Unmarshal(data, decoded.Interface()))
+			assert.Equal(t, msg, decoded.Elem().Interface())
+		})
+	}
+	// as written by the baseline client
+	var add Add
+	require.NoError(t, codec.Unmarshal([]byte(`{"Event":0,"Cluster":"cluster-a","Kind":{"Group":"","Version":"v1","Resource":"pods","AdditionalProperties":null},"Name":"default/nginx","Object":"{}","AdditionalProperties":null}`), &add))
+	assert.Equal(t, Add{Event: eventPtr(EventAdd), Cluster: "cluster-a", Kind: &Kind{Version: "v1", Resource: "pods"}, Name: "default/nginx", Object: "{}"}, add)
+}
+
+// schemas are the JSON schemas of api/asyncapi.yaml, validated with the subset
+// of JSON schema used by the spec.
+type schemas map[string]interface{}
+
+func loadSchemas(t *testing.T) schemas {
+	data, err := os.ReadFile(filepath.Join("..", "api", "asyncapi.yaml"))
+	require.NoError(t, err)
+	data, err = yaml.YAMLToJSON(data)
+	require.NoError(t, err)
+	var spec struct {
+		Components struct {
+			Schemas schemas `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(data, &spec))
+	return spec.Components.Schemas
+}
+
+// validate returns the violations of schema by value, properties not declared
+// by the schema are violations if strict.
+func (s schemas) validate(path string, schema map[string]interface{}, value interface{}, strict bool) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := s[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: unresolved reference %s", path, ref)}
+		}
+		return s.validate(path, resolved, value, strict)
+	}
+	var violations []string
+	if enum, ok := schema["enum"].([]interface{}); ok && !contains(enum, value) {
+		violations = append(violations, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+	}
+	switch schema["type"] {
+	case "object":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: %v is not an object", path, value))
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, field := range fields {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				violations = append(violations, s.validate(path+"."+name, property, field, strict)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				violations = append(violations, s.validate(path+"."+name, additional, field, strict)...)
+			} else if strict {
+				violations = append(violations, fmt.Sprintf("%s: undeclared property %s", path, name))
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: %v is not an array", path, value))
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			violations = append(violations, s.validate(fmt.Sprintf("%s[%d]", path, i), itemSchema, item, strict)...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			violations = append(violations, fmt.Sprintf("%s: %v is not a string", path, value))
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			violations = append(violations, fmt.Sprintf("%s: %v is not an integer", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			violations = append(violations, fmt.Sprintf("%s: %v is not a boolean", path, value))
+		}
+	}
+	return violations
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
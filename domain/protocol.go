@@ -0,0 +1,59 @@
+package domain
+
+const (
+	// ProtocolVersion is the revision of the protocol described in api/asyncapi.yaml.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest revision still spoken.
+	MinProtocolVersion = 1
+	// BaselineProtocolVersion is the revision of the clients predating hello, their
+	// messages are not enveloped, name the fields after the Go fields and encode
+	// events as their index in the event enum.
+	BaselineProtocolVersion = 0
+)
+
+// Capabilities are optional features, used only if both sides advertise them in hello.
+const (
+	// CapabilityApply allows the server to push objects to apply, reported by applyResult
+	CapabilityApply = "apply"
+	// CapabilityDigest allows the client to send digest instead of a full inventory
+	CapabilityDigest = "digest"
+	// CapabilityMergePatch allows the client to send JSON merge patches of the shadow copies
+	CapabilityMergePatch = "patch.merge"
+	// CapabilityCBOR encodes the messages following helloResponse in CBOR instead of JSON
+	CapabilityCBOR = "encoding.cbor"
+	// CapabilityZstd compresses the large messages following helloResponse with zstd
+	CapabilityZstd = "compression.zstd"
+)
+
+// Capabilities lists the features implemented by this version, the encoding
+// and the compression are advertised separately as they are configured.
+var Capabilities = []string{CapabilityApply, CapabilityDigest, CapabilityMergePatch}
+
+// Version is the version of the synchronizer, set at build time.
+var Version = "dev"
+
+// NegotiateVersion returns the highest revision within both ranges, and false
+// if they do not overlap.
+func NegotiateVersion(localMin, localMax, remoteMin, remoteMax int) (int, bool) {
+	version := localMax
+	if remoteMax < version {
+		version = remoteMax
+	}
+	return version, version >= localMin && version >= remoteMin
+}
+
+// IntersectCapabilities returns the capabilities of local also in remote, in
+// the order of local.
+func IntersectCapabilities(local, remote []string) []string {
+	advertised := make(map[string]bool, len(remote))
+	for _, c := range remote {
+		advertised[c] = true
+	}
+	common := []string{}
+	for _, c := range local {
+		if advertised[c] {
+			common = append(common, c)
+		}
+	}
+	return common
+}
@@ -6,3 +6,7 @@ const (
 	CopyStrategy  Strategy = "copy"
 	PatchStrategy Strategy = "patch"
 )
+
+func (s Strategy) IsValid() bool {
+	return s == CopyStrategy || s == PatchStrategy
+}
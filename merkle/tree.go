@@ -0,0 +1,76 @@
+package merkle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/matthyx/synchro-poc/utils"
+)
+
+// Tree is a hierarchical digest of the objects of a kind: the root hash covers
+// the namespace hashes, which cover the checksums of the objects they contain.
+// Two trees can be compared top-down, only descending into the namespaces
+// whose hashes differ.
+type Tree struct {
+	Root       string
+	Namespaces map[string]string
+}
+
+// NewTree builds a tree from object checksums indexed by key (namespace/name).
+func NewTree(checksums map[string]string) (*Tree, error) {
+	t := &Tree{
+		Namespaces: map[string]string{},
+	}
+	namespaces := map[string]map[string]string{}
+	for key, checksum := range checksums {
+		ns, name := utils.KeyToNsName(key)
+		if _, ok := namespaces[ns]; !ok {
+			namespaces[ns] = map[string]string{}
+		}
+		namespaces[ns][name] = checksum
+	}
+	for ns, objects := range namespaces {
+		hash, err := hashNode(objects)
+		if err != nil {
+			return nil, fmt.Errorf("hash namespace %s: %w", ns, err)
+		}
+		t.Namespaces[ns] = hash
+	}
+	root, err := hashNode(t.Namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("hash root: %w", err)
+	}
+	t.Root = root
+	return t, nil
+}
+
+// Diff returns the sorted namespaces whose hashes differ from the given ones,
+// including namespaces only present on one side.
+func (t *Tree) Diff(root string, namespaces map[string]string) []string {
+	if t.Root == root {
+		return nil
+	}
+	var diff []string
+	for ns, hash := range t.Namespaces {
+		if namespaces[ns] != hash {
+			diff = append(diff, ns)
+		}
+	}
+	for ns := range namespaces {
+		if _, ok := t.Namespaces[ns]; !ok {
+			diff = append(diff, ns)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// hashNode hashes the children hashes of a node, independently of their order.
+func hashNode(children map[string]string) (string, error) {
+	data, err := json.Marshal(children)
+	if err != nil {
+		return "", err
+	}
+	return utils.CanonicalHash(data)
+}
@@ -0,0 +1,51 @@
+package merkle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeDiff(t *testing.T) {
+	checksums := map[string]string{
+		"default/nginx":      "a",
+		"default/redis":      "b",
+		"kube-system/dns":    "c",
+		"kube-public/config": "d",
+		"/node":              "e",
+	}
+	tree, err := NewTree(checksums)
+	assert.NoError(t, err)
+	same, err := NewTree(checksums)
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Root, same.Root)
+	assert.Empty(t, tree.Diff(same.Root, same.Namespaces))
+
+	other, err := NewTree(map[string]string{
+		"default/nginx":      "a",
+		"default/redis":      "modified",
+		"kube-system/dns":    "c",
+		"kube-public/config": "d",
+		"monitoring/added":   "f",
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, tree.Root, other.Root)
+	assert.Equal(t, []string{"", "default", "monitoring"}, tree.Diff(other.Root, other.Namespaces))
+
+	// a namespace hash only covers the objects of that namespace
+	defaults, err := NewTree(map[string]string{"default/nginx": "a", "default/redis": "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "kube-public", "kube-system"}, tree.Diff(defaults.Root, defaults.Namespaces))
+	clusterScoped, err := NewTree(map[string]string{"/node": "e"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default", "kube-public", "kube-system"}, tree.Diff(clusterScoped.Root, clusterScoped.Namespaces))
+}
+
+func TestTreeEmpty(t *testing.T) {
+	empty, err := NewTree(nil)
+	assert.NoError(t, err)
+	tree, err := NewTree(map[string]string{"default/nginx": "a"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, empty.Root, tree.Root)
+	assert.Equal(t, []string{"default"}, empty.Diff(tree.Root, tree.Namespaces))
+}
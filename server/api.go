@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// coreGroup stands for the empty group in URLs
+	coreGroup    = "core"
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+type clusterList struct {
+	Clusters []string `json:"clusters"`
+}
+
+type resourceList struct {
+	Resources []string `json:"resources"`
+}
+
+type objectMeta struct {
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	Updated   time.Time `json:"updated"`
+}
+
+type objectList struct {
+	Items    []objectMeta `json:"items"`
+	Continue string       `json:"continue,omitempty"`
+}
+
+type objectDetail struct {
+	Cluster  string `json:"cluster"`
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	objectMeta
+	Object json.RawMessage `json:"object"`
+}
+
+// QueryHandler returns a read-only HTTP API over the synchronized objects:
+//
+//	GET /clusters
+//	GET /clusters/{cluster}
+//	GET /clusters/{cluster}/{group}/{version}/{resource}?namespace=&limit=&continue=
+//	GET /clusters/{cluster}/{group}/{version}/{resource}/{name}
+//	GET /clusters/{cluster}/{group}/{version}/{resource}/{namespace}/{name}
+//
+// where the core group is written "core". Callers are authenticated like the
+// websocket clients, and only see the clusters they are allowed for.
+func (s *Server) QueryHandler() http.Handler {
+	return s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if parts[0] != "clusters" {
+			http.NotFound(w, r)
+			return
+		}
+		parts = parts[1:]
+		id := requestIdentity(r)
+		if len(parts) > 0 && !id.allows(parts[0]) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var resp interface{}
+		var err error
+		switch len(parts) {
+		case 0:
+			resp, err = s.listClusters(id)
+		case 1:
+			resp, err = s.listResources(parts[0])
+		case 4:
+			resp, err = s.listObjects(parts[0], urlResource(parts[1:4]), r)
+		case 5:
+			resp, err = s.getObject(store.Key{Cluster: parts[0], Resource: urlResource(parts[1:4]), Name: parts[4]})
+		case 6:
+			resp, err = s.getObject(store.Key{Cluster: parts[0], Resource: urlResource(parts[1:4]), Namespace: parts[4], Name: parts[5]})
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		var badRequest errBadRequest
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.As(err, &badRequest):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			logger.L().Error("cannot serve query", helpers.String("path", r.URL.Path), helpers.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			logger.L().Error("cannot write query response", helpers.Error(err))
+		}
+	}))
+}
+
+type errBadRequest struct {
+	error
+}
+
+// listClusters returns the clusters id is allowed for.
+func (s *Server) listClusters(id *identity) (*clusterList, error) {
+	clusters, err := s.store.Clusters()
+	if err != nil {
+		return nil, fmt.Errorf("list clusters: %w", err)
+	}
+	allowed := make([]string, 0, len(clusters))
+	for _, cluster := range clusters {
+		if id.allows(cluster) {
+			allowed = append(allowed, cluster)
+		}
+	}
+	return &clusterList{Clusters: allowed}, nil
+}
+
+func (s *Server) listResources(cluster string) (*resourceList, error) {
+	resources, err := s.store.Resources(cluster)
+	if err != nil {
+		return nil, fmt.Errorf("list resources: %w", err)
+	}
+	if len(resources) == 0 {
+		return nil, store.ErrNotFound
+	}
+	list := &resourceList{Resources: make([]string, 0, len(resources))}
+	for _, resource := range resources {
+		group := resource.Group
+		if group == "" {
+			group = coreGroup
+		}
+		list.Resources = append(list.Resources, strings.Join([]string{group, resource.Version, resource.Resource}, "/"))
+	}
+	return list, nil
+}
+
+func (s *Server) listObjects(cluster string, resource schema.GroupVersionResource, r *http.Request) (*objectList, error) {
+	query := r.URL.Query()
+	limit := defaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			return nil, errBadRequest{fmt.Errorf("limit must be between 1 and %d", maxLimit)}
+		}
+	}
+	// the continue token is the last key returned in the previous page
+	var after *store.Key
+	if c := query.Get("continue"); c != "" {
+		token, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return nil, errBadRequest{errors.New("invalid continue token")}
+		}
+		ns, name := utils.KeyToNsName(string(token))
+		after = &store.Key{Namespace: ns, Name: name}
+	}
+	_, hasNamespace := query["namespace"]
+	namespace := query.Get("namespace")
+	keys, err := s.store.List(cluster, resource)
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	list := &objectList{Items: []objectMeta{}}
+	for _, key := range keys {
+		if hasNamespace && key.Namespace != namespace {
+			continue
+		}
+		if after != nil && (key.Namespace < after.Namespace || key.Namespace == after.Namespace && key.Name <= after.Name) {
+			continue
+		}
+		if len(list.Items) == limit {
+			last := list.Items[len(list.Items)-1]
+			list.Continue = base64.RawURLEncoding.EncodeToString([]byte(utils.NsNameToKey(last.Namespace, last.Name)))
+			break
+		}
+		object, err := s.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get object: %w", err)
+		}
+		checksum := s.hashing.checksum(key, object.Data)
+		list.Items = append(list.Items, objectMeta{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+			Checksum:  checksum,
+			Updated:   object.Updated,
+		})
+	}
+	return list, nil
+}
+
+func (s *Server) getObject(key store.Key) (*objectDetail, error) {
+	object, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	checksum := s.hashing.checksum(key, object.Data)
+	data := object.Data
+	if !json.Valid(data) {
+		// return invalid objects as a JSON string
+		data, _ = json.Marshal(string(data))
+	}
+	return &objectDetail{
+		Cluster:  key.Cluster,
+		Group:    key.Resource.Group,
+		Version:  key.Resource.Version,
+		Resource: key.Resource.Resource,
+		objectMeta: objectMeta{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+			Checksum:  checksum,
+			Updated:   object.Updated,
+		},
+		Object: data,
+	}, nil
+}
+
+func urlResource(parts []string) schema.GroupVersionResource {
+	group := parts[0]
+	if group == coreGroup {
+		group = ""
+	}
+	return schema.GroupVersionResource{Group: group, Version: parts[1], Resource: parts[2]}
+}
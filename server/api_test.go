@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func query(t *testing.T, h http.Handler, path string, resp interface{}) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code == http.StatusOK && resp != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+	}
+	return rec.Code
+}
+
+func TestQueryHandler(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	for _, add := range []struct{ cluster, name string }{
+		{"cluster-a", "default/nginx"},
+		{"cluster-a", "default/redis"},
+		{"cluster-a", "kube-system/coredns"},
+		{"cluster-a", "/node"},
+		{"cluster-b", "default/nginx"},
+	} {
+		require.NoError(t, s.HandleAdd(newAdd(add.cluster, pods, add.name, `{"name":"`+add.name+`"}`)))
+	}
+	require.NoError(t, s.HandleAdd(newAdd("cluster-a", deployments, "default/nginx", `{}`)))
+	h := s.QueryHandler()
+
+	var clusters clusterList
+	assert.Equal(t, http.StatusOK, query(t, h, "/clusters", &clusters))
+	assert.Equal(t, []string{"cluster-a", "cluster-b"}, clusters.Clusters)
+
+	var resources resourceList
+	assert.Equal(t, http.StatusOK, query(t, h, "/clusters/cluster-a", &resources))
+	assert.Equal(t, []string{"core/v1/pods", "apps/v1/deployments"}, resources.Resources)
+	assert.Equal(t, http.StatusNotFound, query(t, h, "/clusters/unknown", nil))
+
+	var list objectList
+	assert.Equal(t, http.StatusOK, query(t, h, "/clusters/cluster-a/core/v1/pods?namespace=default", &list))
+	assert.Len(t, list.Items, 2)
+	assert.Empty(t, list.Continue)
+
+	// pagination
+	var names []string
+	path := "/clusters/cluster-a/core/v1/pods?limit=3"
+	for {
+		var page objectList
+		require.Equal(t, http.StatusOK, query(t, h, path, &page))
+		for _, item := range page.Items {
+			assert.NotEmpty(t, item.Checksum)
+			assert.False(t, item.Updated.IsZero())
+			names = append(names, item.Namespace+"/"+item.Name)
+		}
+		if page.Continue == "" {
+			break
+		}
+		path = "/clusters/cluster-a/core/v1/pods?limit=3&continue=" + page.Continue
+	}
+	assert.Equal(t, []string{"/node", "default/nginx", "default/redis", "kube-system/coredns"}, names)
+	assert.Equal(t, http.StatusBadRequest, query(t, h, "/clusters/cluster-a/core/v1/pods?limit=0", nil))
+
+	var detail objectDetail
+	assert.Equal(t, http.StatusOK, query(t, h, "/clusters/cluster-b/core/v1/pods/default/nginx", &detail))
+	assert.Equal(t, "cluster-b", detail.Cluster)
+	assert.Equal(t, "pods", detail.Resource)
+	assert.Equal(t, newChecksum("", nil, "", `{"name":"default/nginx"}`).Checksum, detail.Checksum)
+	assert.JSONEq(t, `{"name":"default/nginx"}`, string(detail.Object))
+	assert.Equal(t, http.StatusOK, query(t, h, "/clusters/cluster-a/core/v1/pods/node", &detail))
+	assert.Equal(t, "node", detail.Name)
+	assert.Equal(t, http.StatusNotFound, query(t, h, "/clusters/cluster-b/core/v1/pods/default/redis", nil))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/clusters", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
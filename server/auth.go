@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/config"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// identity is an authenticated client and the clusters it may synchronize.
+type identity struct {
+	name     string
+	clusters map[string]bool
+}
+
+func (id *identity) allows(cluster string) bool {
+	return id == nil || id.clusters[cluster]
+}
+
+// Authenticator authenticates clients during the websocket upgrade, either
+// with a bearer token or with a verified client certificate (mTLS).
+type Authenticator struct {
+	// tokens are indexed by their hash so that lookups do not depend on the token value
+	tokens      map[[sha256.Size]byte]*identity
+	commonNames map[string]*identity
+}
+
+func NewAuthenticator(credentials []config.Credential) (*Authenticator, error) {
+	a := &Authenticator{
+		tokens:      map[[sha256.Size]byte]*identity{},
+		commonNames: map[string]*identity{},
+	}
+	for i, c := range credentials {
+		id := &identity{clusters: map[string]bool{}}
+		for _, cluster := range c.Clusters {
+			id.clusters[cluster] = true
+		}
+		switch {
+		case c.Token != "" && c.CommonName != "":
+			return nil, fmt.Errorf("credential %d has both a token and a common name", i)
+		case c.Token != "":
+			id.name = fmt.Sprintf("token #%d", i)
+			a.tokens[sha256.Sum256([]byte(c.Token))] = id
+		case c.CommonName != "":
+			id.name = "CN=" + c.CommonName
+			a.commonNames[c.CommonName] = id
+		default:
+			return nil, fmt.Errorf("credential %d has neither a token nor a common name", i)
+		}
+	}
+	return a, nil
+}
+
+// Authenticate returns the identity of the client sending r.
+func (a *Authenticator) Authenticate(r *http.Request) (*identity, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported authorization scheme", ErrUnauthenticated)
+		}
+		if id, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+			return id, nil
+		}
+		return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+	}
+	// the certificate chain has already been verified by the TLS handshake
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if id, ok := a.commonNames[cn]; ok {
+			return id, nil
+		}
+		return nil, fmt.Errorf("%w: unknown client certificate %s", ErrUnauthenticated, cn)
+	}
+	return nil, fmt.Errorf("%w: missing credentials", ErrUnauthenticated)
+}
+
+type identityKey struct{}
+
+// authenticate wraps an HTTP API with the authentication of the websocket, the
+// identity of the caller is passed in the request context. All requests are
+// allowed if authentication is disabled.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := s.auth.Authenticate(r)
+		if err != nil {
+			logger.L().Warning("rejected request", helpers.String("remote", r.RemoteAddr), helpers.String("path", r.URL.Path), helpers.Error(err))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// requestIdentity returns the identity of the caller, nil if authentication is disabled.
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityKey{}).(*identity)
+	return id
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestAuthenticate(t *testing.T) {
+	auth, err := NewAuthenticator([]config.Credential{
+		{Token: "secret-a", Clusters: []string{"cluster-a"}},
+		{CommonName: "cluster-b-client", Clusters: []string{"cluster-b", "cluster-c"}},
+	})
+	require.NoError(t, err)
+	withCert := func(cn string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		return r
+	}
+	withToken := func(auth string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", auth)
+		return r
+	}
+
+	id, err := auth.Authenticate(withToken("Bearer secret-a"))
+	require.NoError(t, err)
+	assert.True(t, id.allows("cluster-a"))
+	assert.False(t, id.allows("cluster-b"))
+	id, err = auth.Authenticate(withCert("cluster-b-client"))
+	require.NoError(t, err)
+	assert.True(t, id.allows("cluster-c"))
+	assert.False(t, id.allows("cluster-a"))
+
+	for _, r := range []*http.Request{
+		withToken("Bearer wrong"),
+		withToken("Basic c2VjcmV0LWE="),
+		withCert("unknown"),
+		httptest.NewRequest(http.MethodGet, "/", nil),
+	} {
+		_, err := auth.Authenticate(r)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	}
+}
+
+func TestNewAuthenticatorInvalidCredential(t *testing.T) {
+	_, err := NewAuthenticator([]config.Credential{{Clusters: []string{"cluster-a"}}})
+	assert.Error(t, err)
+	_, err = NewAuthenticator([]config.Credential{{Token: "a", CommonName: "b"}})
+	assert.Error(t, err)
+}
+
+func TestServerAuthentication(t *testing.T) {
+	auth, err := NewAuthenticator([]config.Credential{{Token: "secret-a", Clusters: []string{"cluster-a"}}})
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewServer(store.NewMemoryStore(), auth))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	dialer := func(token string) ws.Dialer {
+		return ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{"Authorization": []string{"Bearer " + token}})}
+	}
+	// upgrade is refused without valid credentials
+	_, _, _, err = ws.DefaultDialer.Dial(context.Background(), url)
+	assert.Error(t, err)
+	_, _, _, err = dialer("wrong").Dial(context.Background(), url)
+	assert.Error(t, err)
+	// the session is rejected for a cluster the token is not allowed for
+	conn, _, _, err := dialer("secret-a").Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+	resp := hello(t, conn, domain.Hello{Cluster: "cluster-b", ProtocolVersion: domain.ProtocolVersion})
+	assert.False(t, resp.Accepted)
+	assert.Contains(t, resp.Reason, "not allowed")
+	conn, _, _, err = dialer("secret-a").Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+	resp = hello(t, conn, domain.Hello{Cluster: "cluster-a", ProtocolVersion: domain.ProtocolVersion})
+	assert.True(t, resp.Accepted, resp.Reason)
+}
+
+func TestHTTPAuthorization(t *testing.T) {
+	auth, err := NewAuthenticator([]config.Credential{{Token: "secret-a", Clusters: []string{"cluster-a"}}})
+	require.NoError(t, err)
+	s := NewServer(store.NewMemoryStore(), auth)
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	require.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{}`)))
+	require.NoError(t, s.HandleAdd(newAdd("cluster-b", pods, "default/nginx", `{}`)))
+	request := func(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(`{"apiVersion":"v1","kind":"Pod"}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	tests := []struct {
+		handler http.Handler
+		method  string
+		path    string
+	}{
+		{s.QueryHandler(), http.MethodGet, "/clusters/cluster-b"},
+		{s.QueryHandler(), http.MethodGet, "/clusters/cluster-b/core/v1/pods/default/nginx"},
+		{s.DesiredStateHandler(), http.MethodPut, "/desired/cluster-b/core/v1/pods/default/nginx"},
+		{s.DesiredStateHandler(), http.MethodDelete, "/desired/cluster-b/core/v1/pods/default/nginx"},
+		{s.ChangeFeedHandler(), http.MethodGet, "/watch?cluster=cluster-b"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, http.StatusUnauthorized, request(tt.handler, tt.method, tt.path, "").Code, tt.path)
+		assert.Equal(t, http.StatusUnauthorized, request(tt.handler, tt.method, tt.path, "wrong").Code, tt.path)
+		assert.Equal(t, http.StatusForbidden, request(tt.handler, tt.method, tt.path, "secret-a").Code, tt.path)
+	}
+	_, ok := s.desired.get(store.Key{Cluster: "cluster-b", Resource: podsResource, Namespace: "default", Name: "nginx"})
+	assert.False(t, ok)
+
+	// allowed clusters only
+	rec := request(s.QueryHandler(), http.MethodGet, "/clusters", "secret-a")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"clusters":["cluster-a"]}`, rec.Body.String())
+	assert.Equal(t, http.StatusOK, request(s.QueryHandler(), http.MethodGet, "/clusters/cluster-a", "secret-a").Code)
+	assert.Equal(t, http.StatusAccepted, request(s.DesiredStateHandler(), http.MethodPut, "/desired/cluster-a/core/v1/pods/default/nginx", "secret-a").Code)
+	filter := changeFilter{identity: auth.tokens[sha256.Sum256([]byte("secret-a"))]}
+	assert.True(t, filter.matches(store.Key{Cluster: "cluster-a", Resource: podsResource}))
+	assert.False(t, filter.matches(store.Key{Cluster: "cluster-b", Resource: podsResource}))
+}
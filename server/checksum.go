@@ -0,0 +1,100 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type hashingKey struct {
+	cluster  string
+	resource schema.GroupVersionResource
+}
+
+// hashing holds the checksum settings advertised by the clients in hello, and
+// detects the objects whose checksums still differ after being retrieved, which
+// happens when both sides do not hash objects the same way.
+type hashing struct {
+	mu          sync.Mutex
+	ignorePaths map[hashingKey][]string
+	// retrieving are the checksums sent by the client for the objects being retrieved
+	retrieving map[store.Key]string
+	// mismatches are the checksums that could not be matched after a retrieve
+	mismatches map[store.Key]string
+}
+
+func newHashing() *hashing {
+	return &hashing{
+		ignorePaths: map[hashingKey][]string{},
+		retrieving:  map[store.Key]string{},
+		mismatches:  map[store.Key]string{},
+	}
+}
+
+func (h *hashing) setIgnorePaths(cluster string, resource schema.GroupVersionResource, paths []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ignorePaths[hashingKey{cluster: cluster, resource: resource}] = paths
+}
+
+// checksum hashes an object of key the same way as its client, or with the
+// default settings if the client has not connected yet.
+func (h *hashing) checksum(key store.Key, object []byte) string {
+	h.mu.Lock()
+	paths, ok := h.ignorePaths[hashingKey{cluster: key.Cluster, resource: key.Resource}]
+	h.mu.Unlock()
+	if !ok {
+		paths = utils.DefaultIgnorePaths
+	}
+	checksum, _ := utils.CanonicalHashIgnoring(object, paths)
+	return checksum
+}
+
+// retrieve records the checksum of an object before retrieving it, it returns
+// false if that checksum already mismatched, and retrieving again is pointless.
+func (h *hashing) retrieve(key store.Key, remote string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mismatches[key] == remote {
+		return false
+	}
+	h.retrieving[key] = remote
+	return true
+}
+
+// retrieved compares the checksum of a retrieved object with the one sent by
+// the client, and returns false on mismatch.
+func (h *hashing) retrieved(key store.Key, local string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	remote, ok := h.retrieving[key]
+	if !ok {
+		return true
+	}
+	delete(h.retrieving, key)
+	if remote == local {
+		delete(h.mismatches, key)
+		return true
+	}
+	h.mismatches[key] = remote
+	logger.L().Error("checksum mismatch after retrieve, client and server do not hash objects the same way",
+		helpers.String("cluster", key.Cluster),
+		helpers.String("resource", key.Resource.String()),
+		helpers.String("name", utils.NsNameToKey(key.Namespace, key.Name)),
+		helpers.String("local checksum", local),
+		helpers.String("remote checksum", remote),
+		helpers.Interface("ignore paths", h.ignorePaths[hashingKey{cluster: key.Cluster, resource: key.Resource}]))
+	return false
+}
+
+// forget drops the state of a deleted object.
+func (h *hashing) forget(key store.Key) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.retrieving, key)
+	delete(h.mismatches, key)
+}
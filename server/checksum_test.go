@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestChecksumIgnorePaths(t *testing.T) {
+	srv := NewServer(store.NewMemoryStore(), nil)
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	srv.hashing.setIgnorePaths("cluster-a", podsResource, []string{".status"})
+	require.NoError(t, srv.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{"spec":{"nodeName":"node-1"},"status":{"phase":"Pending"}}`)))
+	// the client ignores the status too
+	checksum := newChecksum("cluster-a", pods, "default/nginx", `{}`)
+	checksum.Checksum, _ = utils.CanonicalHashIgnoring([]byte(`{"spec":{"nodeName":"node-1"},"status":{"phase":"Running"}}`), []string{".status"})
+	retrieve, err := srv.HandleChecksum(checksum)
+	assert.NoError(t, err)
+	assert.Nil(t, retrieve)
+	// other clusters use the default settings
+	require.NoError(t, srv.HandleAdd(newAdd("cluster-b", pods, "default/nginx", `{"spec":{"nodeName":"node-1"},"status":{"phase":"Pending"}}`)))
+	checksum.Cluster = "cluster-b"
+	retrieve, err = srv.HandleChecksum(checksum)
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieve)
+}
+
+func TestChecksumMismatchReported(t *testing.T) {
+	srv := NewServer(store.NewMemoryStore(), nil)
+	sub := srv.feed.subscribe(changeFilter{})
+	defer srv.feed.unsubscribe(sub)
+	// the client ignores the status, but the server was not told
+	clientChecksum := newChecksum("cluster-a", pods, "default/nginx", `{}`)
+	clientChecksum.Checksum, _ = utils.CanonicalHashIgnoring([]byte(`{"status":{"phase":"Running"}}`), []string{".status"})
+	retrieve, err := srv.HandleChecksum(clientChecksum)
+	assert.NoError(t, err)
+	require.NotNil(t, retrieve)
+	require.NoError(t, srv.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{"status":{"phase":"Running"}}`)))
+	assert.Equal(t, ChangeAdd, (<-sub.ch).Type)
+	mismatch := <-sub.ch
+	assert.Equal(t, ChangeMismatch, mismatch.Type)
+	assert.Equal(t, "default/nginx", mismatch.Name)
+	// the same checksum is not retrieved again
+	retrieve, err = srv.HandleChecksum(clientChecksum)
+	assert.NoError(t, err)
+	assert.Nil(t, retrieve)
+	// but a new one is
+	retrieve, err = srv.HandleChecksum(newChecksum("cluster-a", pods, "default/nginx", `{"status":{"phase":"Succeeded"}}`))
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieve)
+	require.NoError(t, srv.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{"status":{"phase":"Succeeded"}}`)))
+	assert.Equal(t, ChangeAdd, (<-sub.ch).Type)
+	assert.Empty(t, sub.ch)
+}
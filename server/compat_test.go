@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// TestCompatibilityMatrix opens sessions between the server and clients offering
+// different revisions and capabilities, and checks the features they agree on.
+func TestCompatibilityMatrix(t *testing.T) {
+	type peer struct {
+		min, max     int
+		capabilities []string
+	}
+	tests := []struct {
+		name         string
+		client       peer
+		accepted     bool
+		capabilities []string
+	}{
+		{
+			name:     "client without min protocol version",
+			client:   peer{max: domain.ProtocolVersion},
+			accepted: true,
+		},
+		{
+			name:         "current client",
+			client:       peer{min: domain.MinProtocolVersion, max: domain.ProtocolVersion, capabilities: domain.Capabilities},
+			accepted:     true,
+			capabilities: domain.Capabilities,
+		},
+		{
+			name:         "future client",
+			client:       peer{min: domain.ProtocolVersion, max: domain.ProtocolVersion + 1, capabilities: append([]string{"batching"}, domain.Capabilities...)},
+			accepted:     true,
+			capabilities: domain.Capabilities,
+		},
+		{
+			name:     "future-only client",
+			client:   peer{min: domain.ProtocolVersion + 1, max: domain.ProtocolVersion + 1, capabilities: domain.Capabilities},
+			accepted: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemoryStore()
+			srv := httptest.NewServer(NewServer(st, nil))
+			defer srv.Close()
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+			require.NoError(t, err)
+			defer conn.Close()
+			resp := hello(t, conn, domain.Hello{
+				Cluster:            "cluster-a",
+				ProtocolVersion:    tt.client.max,
+				MinProtocolVersion: tt.client.min,
+				Capabilities:       tt.client.capabilities,
+				Resources:          []domain.Resource{{Kind: pods, Strategy: domain.PatchStrategy}},
+			})
+			require.Equal(t, tt.accepted, resp.Accepted, resp.Reason)
+			if !tt.accepted {
+				assert.Contains(t, resp.Reason, "unsupported protocol version")
+				return
+			}
+			assert.Equal(t, domain.ProtocolVersion, resp.ProtocolVersion)
+			assert.Equal(t, tt.capabilities, resp.Capabilities)
+
+			send(t, conn, newAdd("cluster-a", pods, "default/nginx", `{}`))
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			data, err := wsutil.ReadServerBinary(conn)
+			require.NoError(t, err)
+			var ack domain.Ack
+			require.NoError(t, json.Unmarshal(data, &ack))
+			assert.Equal(t, domain.EventAck, *ack.Event)
+			key := store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+			assert.Eventually(t, func() bool {
+				_, err := st.Get(key)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// TestBaselineClient serves a client predating hello, which sends its messages
+// right away, not enveloped, with the Go field names and events as integers.
+func TestBaselineClient(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := NewServer(st, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+	kind := `"Kind":{"Group":"","Version":"v1","Resource":"pods","AdditionalProperties":null}`
+	write := func(msg string) {
+		require.NoError(t, wsutil.WriteClientBinary(conn, []byte(msg)))
+	}
+	key := store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+	stored := func(object string) func() bool {
+		return func() bool {
+			obj, err := st.Get(key)
+			return err == nil && string(obj.Data) == object
+		}
+	}
+	write(`{"Event":0,"Cluster":"cluster-a",` + kind + `,"Name":"default/nginx","Object":"{\"a\":1}","AdditionalProperties":null}`)
+	assert.Eventually(t, stored(`{"a":1}`), 5*time.Second, 10*time.Millisecond)
+	write(`{"Event":3,"Cluster":"cluster-a",` + kind + `,"Name":"default/nginx","Patch":"{\"b\":2}","AdditionalProperties":null}`)
+	assert.Eventually(t, stored(`{"a":1,"b":2}`), 5*time.Second, 10*time.Millisecond)
+
+	// messages of other clusters are rejected
+	write(`{"Event":0,"Cluster":"cluster-b",` + kind + `,"Name":"default/nginx","Object":"{}","AdditionalProperties":null}`)
+
+	// the server answers in the same format
+	write(`{"Event":1,"Cluster":"cluster-a",` + kind + `,"Name":"default/nginx","Checksum":"outdated","AdditionalProperties":null}`)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	data, err := wsutil.ReadServerBinary(conn)
+	require.NoError(t, err)
+	var retrieve map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &retrieve))
+	assert.Equal(t, float64(domain.EventRetrieve), retrieve["Event"])
+	assert.Equal(t, "cluster-a", retrieve["Cluster"])
+	assert.Equal(t, "default/nginx", retrieve["Name"])
+
+	clusters, err := st.Clusters()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster-a"}, clusters)
+
+	// objects are not pushed to clients unable to apply them
+	require.NoError(t, s.PutDesired(key, []byte(`{}`)))
+	obj, ok := s.desired.get(key)
+	require.True(t, ok)
+	assert.Equal(t, DesiredPending, obj.status)
+}
+
+func TestSessionRejectsCapabilitiesNotNegotiated(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	sess, err := s.handleHello(domain.Hello{
+		Event:           eventPtr(domain.EventHello),
+		Cluster:         "cluster-a",
+		ProtocolVersion: domain.ProtocolVersion,
+		Capabilities:    []string{domain.CapabilityDigest},
+		Resources:       []domain.Resource{{Kind: pods, Strategy: domain.PatchStrategy}},
+	}, nil)
+	require.NoError(t, err)
+	assert.NoError(t, sess.checkMessage(domain.Generic{Event: eventPtr(domain.EventDigest), Cluster: "cluster-a", Kind: pods}))
+	assert.ErrorContains(t, sess.checkMessage(domain.Generic{Event: eventPtr(domain.EventPatch), Cluster: "cluster-a", Kind: pods}), "capability patch.merge was not negotiated")
+	assert.ErrorContains(t, sess.checkMessage(domain.Generic{Event: eventPtr(domain.EventApplyResult), Cluster: "cluster-a", Kind: pods}), "capability apply was not negotiated")
+	// objects are not pushed to clients unable to apply them, but kept for the next session
+	s.register(sess)
+	_, status := desire(t, s.DesiredStateHandler(), http.MethodPut, "/desired/cluster-a/core/v1/pods/default/nginx", `{}`)
+	assert.Equal(t, DesiredPending, status.Status)
+	assert.Contains(t, status.Reason, "does not support applying objects")
+}
+
+func eventPtr(event domain.Event) *domain.Event {
+	return &event
+}
+
+func TestCBORSession(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := NewServer(st, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+	resp := hello(t, conn, domain.Hello{
+		Cluster:         "cluster-a",
+		ProtocolVersion: domain.ProtocolVersion,
+		Capabilities:    []string{domain.CapabilityApply, domain.CapabilityCBOR},
+		Resources:       []domain.Resource{{Kind: pods, Strategy: domain.CopyStrategy}},
+	})
+	require.True(t, resp.Accepted, resp.Reason)
+	assert.Equal(t, []string{domain.CapabilityApply, domain.CapabilityCBOR}, resp.Capabilities)
+	codec := domain.NewCodec(resp.ProtocolVersion, resp.Capabilities)
+
+	// messages of the client are decoded and acknowledged in CBOR
+	data, err := codec.Marshal(newAdd("cluster-a", pods, "default/nginx", `{"a":"\"b\""}`))
+	require.NoError(t, err)
+	data, err = codec.Marshal(domain.Envelope{Event: eventPtr(domain.EventEnvelope), Id: "1", Seq: 1, Message: string(data)})
+	require.NoError(t, err)
+	require.NoError(t, wsutil.WriteClientBinary(conn, data))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	data, err = wsutil.ReadServerBinary(conn)
+	require.NoError(t, err)
+	var ack domain.Ack
+	require.NoError(t, codec.Unmarshal(data, &ack))
+	assert.Equal(t, domain.EventAck, *ack.Event)
+	assert.Equal(t, "1", ack.Id)
+	key := store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+	assert.Eventually(t, func() bool {
+		object, err := st.Get(key)
+		return err == nil && string(object.Data) == `{"a":"\"b\""}`
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and so are the messages of the server
+	require.NoError(t, s.PutDesired(key, []byte(`{"b":1}`)))
+	data, err = wsutil.ReadServerBinary(conn)
+	require.NoError(t, err)
+	var envelope domain.Envelope
+	require.NoError(t, codec.Unmarshal(data, &envelope))
+	var add domain.Add
+	require.NoError(t, codec.Unmarshal([]byte(envelope.Message), &add))
+	assert.Equal(t, `{"b":1}`, add.Object)
+}
+
+func TestUseCompression(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	assert.NotContains(t, s.capabilities, domain.CapabilityZstd)
+	enabled := config.CompressionConfig{Enabled: true, Threshold: 1 << 10, Level: domain.DefaultCompressionLevel}
+	require.NoError(t, s.UseCompression(enabled))
+	require.NoError(t, s.UseCompression(enabled))
+	assert.Equal(t, append(append([]string{}, domain.Capabilities...), domain.CapabilityCBOR, domain.CapabilityZstd, domain.DictionaryCapability(32768)), s.capabilities)
+	assert.NotNil(t, s.compressor)
+	require.NoError(t, s.UseCompression(config.CompressionConfig{}))
+	assert.NotContains(t, s.capabilities, domain.CapabilityZstd)
+	assert.NotContains(t, s.capabilities, domain.DictionaryCapability(32768))
+	assert.Nil(t, s.compressor)
+}
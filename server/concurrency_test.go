@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// TestServerConcurrentClients drives many simulated clients in parallel,
+// run it with -race to check the server core for data races.
+func TestServerConcurrentClients(t *testing.T) {
+	const (
+		clusters         = 10
+		connsPerCluster  = 5
+		patchesPerClient = 20
+	)
+	st := store.NewMemoryStore()
+	srv := httptest.NewServer(NewServer(st, nil))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// each cluster starts with an empty object
+	for c := 0; c < clusters; c++ {
+		conn := dialSession(t, url, clusterName(c))
+		send(t, conn, newAdd(clusterName(c), pods, "default/nginx", `{}`))
+		_ = conn.Close()
+	}
+	key := func(c int) store.Key {
+		return store.Key{Cluster: clusterName(c), Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+	}
+	assert.Eventually(t, func() bool {
+		for c := 0; c < clusters; c++ {
+			if _, err := st.Get(key(c)); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// then several connections per cluster patch distinct fields of the same object
+	var wg sync.WaitGroup
+	for c := 0; c < clusters; c++ {
+		for i := 0; i < connsPerCluster; i++ {
+			wg.Add(1)
+			go func(c, i int) {
+				defer wg.Done()
+				conn := dialSession(t, url, clusterName(c))
+				defer conn.Close()
+				// drain server responses
+				go func() {
+					for {
+						if _, err := wsutil.ReadServerBinary(conn); err != nil {
+							return
+						}
+					}
+				}()
+				event := domain.EventPatch
+				for p := 0; p < patchesPerClient; p++ {
+					send(t, conn, domain.Patch{
+						Event:   &event,
+						Cluster: clusterName(c),
+						Kind:    pods,
+						Name:    "default/nginx",
+						Patch:   fmt.Sprintf(`{"conn%d":%d}`, i, p),
+					})
+					send(t, conn, newChecksum(clusterName(c), pods, "default/nginx", `{}`))
+				}
+			}(c, i)
+		}
+	}
+	wg.Wait()
+
+	// no patch is lost, and clusters never see each other's objects
+	expected := map[string]interface{}{}
+	for i := 0; i < connsPerCluster; i++ {
+		expected[fmt.Sprintf("conn%d", i)] = float64(patchesPerClient - 1)
+	}
+	assert.Eventually(t, func() bool {
+		for c := 0; c < clusters; c++ {
+			object, err := st.Get(key(c))
+			if err != nil {
+				return false
+			}
+			var actual map[string]interface{}
+			if err := json.Unmarshal(object.Data, &actual); err != nil || !assert.ObjectsAreEqual(expected, actual) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func clusterName(c int) string {
+	return fmt.Sprintf("cluster-%d", c)
+}
+
+// dialSession connects to the server and opens a session for cluster.
+func dialSession(t *testing.T, url, cluster string) net.Conn {
+	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), url)
+	require.NoError(t, err)
+	resp := hello(t, conn, domain.Hello{Cluster: cluster, ProtocolVersion: domain.ProtocolVersion, Capabilities: domain.Capabilities, Resources: []domain.Resource{
+		{Kind: pods, Strategy: domain.PatchStrategy},
+		{Kind: deployments, Strategy: domain.CopyStrategy},
+	}})
+	require.True(t, resp.Accepted, resp.Reason)
+	return conn
+}
+
+func hello(t *testing.T, conn net.Conn, hello domain.Hello) domain.HelloResponse {
+	event := domain.EventHello
+	hello.Event = &event
+	data, err := json.Marshal(hello)
+	require.NoError(t, err)
+	require.NoError(t, wsutil.WriteClientBinary(conn, data))
+	data, err = wsutil.ReadServerBinary(conn)
+	require.NoError(t, err)
+	var resp domain.HelloResponse
+	require.NoError(t, json.Unmarshal(data, &resp))
+	require.Equal(t, domain.EventHelloResponse, *resp.Event)
+	return resp
+}
+
+// seqs holds the last sequence number sent on each connection.
+var seqs sync.Map
+
+// send wraps msg in an envelope, like the client once the session is open.
+func send(t *testing.T, conn io.Writer, msg interface{}) {
+	data, err := json.Marshal(msg)
+	assert.NoError(t, err)
+	last, _ := seqs.LoadOrStore(conn, new(atomic.Int64))
+	seq := last.(*atomic.Int64).Add(1)
+	event := domain.EventEnvelope
+	data, err = json.Marshal(domain.Envelope{Event: &event, Id: fmt.Sprint(seq), Seq: int(seq), Message: string(data)})
+	assert.NoError(t, err)
+	assert.NoError(t, wsutil.WriteClientBinary(conn, data))
+}
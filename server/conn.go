@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/domain"
+)
+
+// wsConn is a websocket connection safe for concurrent writes.
+type wsConn struct {
+	net.Conn
+	mu sync.Mutex
+	// nextID and seq number the envelopes sent on the connection
+	nextID uint64
+	seq    int
+	// compressor compresses the messages following helloResponse if negotiated
+	compressor *domain.Compressor
+}
+
+// Write is used by the reader to answer control frames.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// writeMessage writes a message, compressed once negotiated if large enough.
+func (c *wsConn) writeMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return wsutil.WriteServerBinary(c.Conn, c.compressor.Compress(data))
+}
+
+// send wraps a message in an envelope encoded by codec and writes it, the server
+// does not send envelopes again if they are not acknowledged.
+func (c *wsConn) send(message []byte, codec domain.Codec) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	c.seq++
+	event := domain.EventEnvelope
+	data, err := codec.Marshal(domain.Envelope{
+		Event:   &event,
+		Id:      strconv.FormatUint(c.nextID, 10),
+		Seq:     c.seq,
+		Message: string(message),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal envelope: %w", err)
+	}
+	return wsutil.WriteServerBinary(c.Conn, c.compressor.Compress(data))
+}
+
+// ack acknowledges an envelope received from the client.
+func (c *wsConn) ack(envelope domain.Envelope, codec domain.Codec) error {
+	event := domain.EventAck
+	data, err := codec.Marshal(domain.Ack{
+		Event: &event,
+		Id:    envelope.Id,
+		Seq:   envelope.Seq,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal ack: %w", err)
+	}
+	return c.writeMessage(data)
+}
+
+// writeClose sends a close frame, the client is expected to answer with its own.
+// Writes time out at deadline from then on, unless it is zero; it is set before
+// locking to also unblock a pending write to a client not reading.
+func (c *wsConn) writeClose(reason string, deadline time.Time) error {
+	err := c.Conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("set write deadline: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return wsutil.WriteServerMessage(c.Conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, reason))
+}
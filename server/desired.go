@@ -0,0 +1,332 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+)
+
+const (
+	DesiredPending = "pending"
+	DesiredApplied = "applied"
+	DesiredFailed  = "failed"
+
+	maxDesiredSize = 10 << 20
+)
+
+// desiredObject is an object declared through the API for a cluster, pushed to
+// the cluster as an add or a delete message until it reports the result.
+type desiredObject struct {
+	// id identifies the operation in the messages pushed and their results
+	id        string
+	operation domain.Event
+	object    []byte
+	status    string
+	reason    string
+	updated   time.Time
+}
+
+// desiredState holds the desired objects of all clusters, they are not persisted.
+type desiredState struct {
+	mu      sync.Mutex
+	nextID  uint64
+	objects map[store.Key]*desiredObject
+}
+
+func newDesiredState() *desiredState {
+	return &desiredState{
+		objects: map[store.Key]*desiredObject{},
+	}
+}
+
+func (d *desiredState) set(key store.Key, operation domain.Event, object []byte) desiredObject {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	obj := &desiredObject{
+		id:        strconv.FormatUint(d.nextID, 10),
+		operation: operation,
+		object:    object,
+		status:    DesiredPending,
+		updated:   time.Now(),
+	}
+	d.objects[key] = obj
+	return *obj
+}
+
+func (d *desiredState) get(key store.Key) (desiredObject, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	obj, ok := d.objects[key]
+	if !ok {
+		return desiredObject{}, false
+	}
+	return *obj, true
+}
+
+// pending returns the keys of the objects of cluster not applied yet, sorted.
+func (d *desiredState) pending(cluster string) []store.Key {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var keys []store.Key
+	for key, obj := range d.objects {
+		if key.Cluster == cluster && obj.status == DesiredPending {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// result records the outcome of the operation of id, results of a previous
+// operation on the same object are ignored.
+func (d *desiredState) result(key store.Key, id, status, reason string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	obj, ok := d.objects[key]
+	if !ok || obj.id != id {
+		return false
+	}
+	obj.status = status
+	obj.reason = reason
+	obj.updated = time.Now()
+	return true
+}
+
+// postpone records why the operation of id cannot be pushed yet, it stays
+// pending and is pushed again to the next session of the cluster.
+func (d *desiredState) postpone(key store.Key, id, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	obj, ok := d.objects[key]
+	if !ok || obj.id != id || obj.status != DesiredPending {
+		return
+	}
+	obj.reason = reason
+	obj.updated = time.Now()
+}
+
+// PutDesired declares the desired object of key, it is applied by the cluster
+// as soon as it is connected.
+func (s *Server) PutDesired(key store.Key, object []byte) error {
+	var obj map[string]interface{}
+	err := json.Unmarshal(object, &obj)
+	if err != nil {
+		return errBadRequest{fmt.Errorf("invalid object: %w", err)}
+	}
+	s.desired.set(key, domain.EventAdd, object)
+	s.push(key)
+	return nil
+}
+
+// DeleteDesired declares that the object of key must be deleted from the cluster.
+func (s *Server) DeleteDesired(key store.Key) {
+	s.desired.set(key, domain.EventDelete, nil)
+	s.push(key)
+}
+
+// push sends the desired object of key to its cluster, if connected.
+func (s *Server) push(key store.Key) {
+	s.mu.Lock()
+	sess := s.sessions[key.Cluster]
+	s.mu.Unlock()
+	if sess == nil {
+		logger.L().Debug("cluster not connected, desired object is pending",
+			helpers.String("cluster", key.Cluster),
+			helpers.String("key", key.String()))
+		return
+	}
+	s.pushTo(sess, key)
+}
+
+// pushPending sends the desired objects not applied yet to a new session.
+func (s *Server) pushPending(sess *session) {
+	for _, key := range s.desired.pending(sess.cluster) {
+		s.pushTo(sess, key)
+	}
+}
+
+func (s *Server) pushTo(sess *session, key store.Key) {
+	obj, ok := s.desired.get(key)
+	if !ok {
+		return
+	}
+	kind := &domain.Kind{
+		Group:    key.Resource.Group,
+		Version:  key.Resource.Version,
+		Resource: key.Resource.Resource,
+	}
+	// pushed again to the next session, which may support it
+	if !sess.has(domain.CapabilityApply) {
+		s.desired.postpone(key, obj.id, "the cluster does not support applying objects")
+		return
+	}
+	if _, ok := sess.resources[kind.String()]; !ok {
+		s.desired.postpone(key, obj.id, fmt.Sprintf("resource %s is not synchronized by the cluster", kind.String()))
+		return
+	}
+	name := utils.NsNameToKey(key.Namespace, key.Name)
+	var msg interface{}
+	switch obj.operation {
+	case domain.EventAdd:
+		event := domain.EventAdd
+		msg = domain.Add{
+			Event:       &event,
+			Cluster:     key.Cluster,
+			Kind:        kind,
+			Name:        name,
+			Object:      string(obj.object),
+			OperationId: obj.id,
+		}
+	case domain.EventDelete:
+		event := domain.EventDelete
+		msg = domain.Delete{
+			Event:       &event,
+			Cluster:     key.Cluster,
+			Kind:        kind,
+			Name:        name,
+			OperationId: obj.id,
+		}
+	}
+	// stays pending if the write fails, it is pushed again on reconnection
+	err := sess.send(msg)
+	if err != nil {
+		logger.L().Error("cannot push desired object", helpers.Error(err), helpers.String("cluster", key.Cluster))
+		return
+	}
+	logger.L().Info("pushed desired object",
+		helpers.String("cluster", key.Cluster),
+		helpers.String("kind", kind.Resource),
+		helpers.String("resource", name),
+		helpers.Interface("operation", obj.operation.Value()))
+}
+
+// HandleApplyResult records the result of applying a desired object reported by the client.
+func (s *Server) HandleApplyResult(result domain.ApplyResult) error {
+	key, err := objectKey(result.Cluster, result.Kind, result.Name)
+	if err != nil {
+		return err
+	}
+	if result.Operation == nil {
+		return errors.New("missing operation")
+	}
+	status := DesiredApplied
+	if !result.Success {
+		status = DesiredFailed
+		logger.L().Warning("cannot apply desired object",
+			helpers.String("cluster", key.Cluster),
+			helpers.String("kind", result.Kind.Resource),
+			helpers.String("resource", result.Name),
+			helpers.String("reason", result.Reason))
+	}
+	if !s.desired.result(key, result.OperationId, status, result.Reason) {
+		logger.L().Debug("ignoring stale apply result", helpers.String("key", key.String()))
+	}
+	return nil
+}
+
+type desiredStatus struct {
+	Cluster   string    `json:"cluster"`
+	Group     string    `json:"group"`
+	Version   string    `json:"version"`
+	Resource  string    `json:"resource"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Operation string    `json:"operation"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// DesiredStateHandler returns an HTTP API declaring the objects pushed to the clusters:
+//
+//	PUT    /desired/{cluster}/{group}/{version}/{resource}[/{namespace}]/{name}
+//	DELETE /desired/{cluster}/{group}/{version}/{resource}[/{namespace}]/{name}
+//	GET    /desired/{cluster}/{group}/{version}/{resource}[/{namespace}]/{name}
+//
+// where the core group is written "core". PUT and DELETE are accepted before the
+// cluster applies them, GET returns the result reported by the cluster. Callers
+// are authenticated like the websocket clients, and must be allowed for the cluster.
+// Clusters force-apply the objects pushed, it must not be served without authentication.
+func (s *Server) DesiredStateHandler() http.Handler {
+	return s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if parts[0] != "desired" {
+			http.NotFound(w, r)
+			return
+		}
+		parts = parts[1:]
+		var key store.Key
+		switch len(parts) {
+		case 5:
+			key = store.Key{Cluster: parts[0], Resource: urlResource(parts[1:4]), Name: parts[4]}
+		case 6:
+			key = store.Key{Cluster: parts[0], Resource: urlResource(parts[1:4]), Namespace: parts[4], Name: parts[5]}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if !requestIdentity(r).allows(key.Cluster) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		code := http.StatusAccepted
+		switch r.Method {
+		case http.MethodGet:
+			code = http.StatusOK
+		case http.MethodPut:
+			object, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDesiredSize))
+			if err != nil {
+				http.Error(w, "cannot read object", http.StatusBadRequest)
+				return
+			}
+			err = s.PutDesired(key, object)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			s.DeleteDesired(key)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		obj, ok := s.desired.get(key)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		err := json.NewEncoder(w).Encode(desiredStatus{
+			Cluster:   key.Cluster,
+			Group:     key.Resource.Group,
+			Version:   key.Resource.Version,
+			Resource:  key.Resource.Resource,
+			Namespace: key.Namespace,
+			Name:      key.Name,
+			Operation: obj.operation.Value().(string),
+			Status:    obj.status,
+			Reason:    obj.reason,
+			Updated:   obj.updated,
+		})
+		if err != nil {
+			logger.L().Error("cannot write desired state response", helpers.Error(err))
+		}
+	}))
+}
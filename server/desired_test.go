@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func desire(t *testing.T, h http.Handler, method, path, body string) (int, desiredStatus) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var status desiredStatus
+	if rec.Code == http.StatusOK || rec.Code == http.StatusAccepted {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	}
+	return rec.Code, status
+}
+
+// receive reads the next message sent by the server, skipping acknowledgements.
+func receive(t *testing.T, conn net.Conn, msg interface{}) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		data, err := wsutil.ReadServerBinary(conn)
+		require.NoError(t, err)
+		var envelope domain.Envelope
+		require.NoError(t, json.Unmarshal(data, &envelope))
+		if *envelope.Event == domain.EventAck {
+			continue
+		}
+		require.Equal(t, domain.EventEnvelope, *envelope.Event)
+		require.NoError(t, json.Unmarshal([]byte(envelope.Message), msg))
+		return
+	}
+}
+
+func TestDesiredState(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	h := s.DesiredStateHandler()
+	path := "/desired/cluster-a/core/v1/pods/default/nginx"
+	object := `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"}}`
+
+	code, _ := desire(t, h, http.MethodGet, path, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = desire(t, h, http.MethodPut, path, "not json")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// declared while the cluster is not connected
+	code, status := desire(t, h, http.MethodPut, path, object)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "add", status.Operation)
+	assert.Equal(t, DesiredPending, status.Status)
+
+	// pushed once connected
+	conn := dialSession(t, "ws"+strings.TrimPrefix(srv.URL, "http"), "cluster-a")
+	defer conn.Close()
+	var add domain.Add
+	receive(t, conn, &add)
+	assert.Equal(t, domain.EventAdd, *add.Event)
+	assert.Equal(t, pods, add.Kind)
+	assert.Equal(t, "default/nginx", add.Name)
+	assert.JSONEq(t, object, add.Object)
+	assert.NotEmpty(t, add.OperationId)
+	event := domain.EventApplyResult
+	operation := domain.EventAdd
+	send(t, conn, domain.ApplyResult{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Operation: &operation, OperationId: add.OperationId, Success: true})
+	assert.Eventually(t, func() bool {
+		_, status := desire(t, h, http.MethodGet, path, "")
+		return status.Status == DesiredApplied
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a late result of a previous add is ignored
+	code, _ = desire(t, h, http.MethodPut, path, object)
+	assert.Equal(t, http.StatusAccepted, code)
+	var again domain.Add
+	receive(t, conn, &again)
+	assert.NotEqual(t, add.OperationId, again.OperationId)
+	send(t, conn, domain.ApplyResult{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Operation: &operation, OperationId: add.OperationId, Reason: "conflict"})
+	send(t, conn, domain.ApplyResult{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Operation: &operation, OperationId: again.OperationId, Success: true})
+	assert.Eventually(t, func() bool {
+		_, status := desire(t, h, http.MethodGet, path, "")
+		return status.Status == DesiredApplied
+	}, 5*time.Second, 10*time.Millisecond)
+	_, status = desire(t, h, http.MethodGet, path, "")
+	assert.Empty(t, status.Reason)
+
+	// pushed right away while connected
+	code, status = desire(t, h, http.MethodDelete, path, "")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "delete", status.Operation)
+	var del domain.Delete
+	receive(t, conn, &del)
+	assert.Equal(t, domain.EventDelete, *del.Event)
+	assert.Equal(t, "default/nginx", del.Name)
+	// a late result of the add is ignored
+	send(t, conn, domain.ApplyResult{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Operation: &operation, OperationId: again.OperationId, Success: true})
+	operation = domain.EventDelete
+	send(t, conn, domain.ApplyResult{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Operation: &operation, OperationId: del.OperationId, Reason: "forbidden"})
+	assert.Eventually(t, func() bool {
+		_, status := desire(t, h, http.MethodGet, path, "")
+		return status.Status == DesiredFailed && status.Reason == "forbidden"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// kinds not synchronized by the cluster are pushed to the next session synchronizing them
+	servicesPath := "/desired/cluster-a/core/v1/services/default/nginx"
+	_, status = desire(t, h, http.MethodPut, servicesPath, `{}`)
+	assert.Equal(t, DesiredPending, status.Status)
+	assert.Contains(t, status.Reason, "not synchronized")
+	require.NoError(t, conn.Close())
+	services := &domain.Kind{Version: "v1", Resource: "services"}
+	var next net.Conn
+	assert.Eventually(t, func() bool {
+		c, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+		require.NoError(t, err)
+		// accepted once the previous session is gone
+		if !hello(t, c, domain.Hello{Cluster: "cluster-a", ProtocolVersion: domain.ProtocolVersion, Capabilities: domain.Capabilities, Resources: []domain.Resource{
+			{Kind: services, Strategy: domain.CopyStrategy},
+		}}).Accepted {
+			c.Close()
+			return false
+		}
+		next = c
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	defer next.Close()
+	receive(t, next, &add)
+	assert.Equal(t, services, add.Kind)
+	assert.Equal(t, "default/nginx", add.Name)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	ChangeAdd    = "add"
+	ChangePatch  = "patch"
+	ChangeDelete = "delete"
+	// ChangeMismatch reports an object whose checksum differs from the client's
+	// one after being retrieved, the client and server hashing settings differ
+	ChangeMismatch = "mismatch"
+
+	subscriberBuffer = 1000
+	keepAlive        = 30 * time.Second
+)
+
+// Change is a notification sent to the change feed subscribers.
+type Change struct {
+	Type     string       `json:"type"`
+	Cluster  string       `json:"cluster"`
+	Kind     *domain.Kind `json:"kind"`
+	Name     string       `json:"name"`
+	Checksum string       `json:"checksum,omitempty"`
+}
+
+type changeFilter struct {
+	// identity restricts the changes to the clusters it is allowed for
+	identity  *identity
+	clusters  map[string]bool
+	resources map[schema.GroupVersionResource]bool
+}
+
+func (f changeFilter) matches(key store.Key) bool {
+	return f.identity.allows(key.Cluster) &&
+		(len(f.clusters) == 0 || f.clusters[key.Cluster]) &&
+		(len(f.resources) == 0 || f.resources[key.Resource])
+}
+
+type subscriber struct {
+	filter changeFilter
+	ch     chan Change
+}
+
+// feed fans out changes to its subscribers. A subscriber too slow to keep up
+// is closed rather than blocking the server, it is expected to reconnect and
+// catch up using the query API.
+type feed struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+func (f *feed) subscribe(filter changeFilter) *subscriber {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub := &subscriber{
+		filter: filter,
+		ch:     make(chan Change, subscriberBuffer),
+	}
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (f *feed) unsubscribe(sub *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// close ends all subscriptions.
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (f *feed) publish(key store.Key, changeType string, checksum string) {
+	f.mu.Lock()
+	subscribers := len(f.subscribers)
+	f.mu.Unlock()
+	if subscribers == 0 {
+		return
+	}
+	change := Change{
+		Type:    changeType,
+		Cluster: key.Cluster,
+		Kind: &domain.Kind{
+			Group:    key.Resource.Group,
+			Version:  key.Resource.Version,
+			Resource: key.Resource.Resource,
+		},
+		Name:     utils.NsNameToKey(key.Namespace, key.Name),
+		Checksum: checksum,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		if !sub.filter.matches(key) {
+			continue
+		}
+		select {
+		case sub.ch <- change:
+		default:
+			logger.L().Warning("closing slow change feed subscriber")
+			delete(f.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// ChangeFeedHandler returns a Server-Sent Events stream of the changes made to
+// the synchronized objects, filterable by cluster and kind:
+//
+//	GET /watch?cluster={cluster}&kind={group}/{version}/{resource}
+//
+// where both parameters can be repeated, and the core group is written "core".
+// Callers are authenticated like the websocket clients, and only receive the
+// changes of the clusters they are allowed for.
+func (s *Server) ChangeFeedHandler() http.Handler {
+	return s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		filter := changeFilter{
+			identity:  requestIdentity(r),
+			clusters:  map[string]bool{},
+			resources: map[schema.GroupVersionResource]bool{},
+		}
+		for _, cluster := range r.URL.Query()["cluster"] {
+			if !filter.identity.allows(cluster) {
+				http.Error(w, fmt.Sprintf("cluster %q is not allowed", cluster), http.StatusForbidden)
+				return
+			}
+			filter.clusters[cluster] = true
+		}
+		for _, kind := range r.URL.Query()["kind"] {
+			parts := strings.Split(kind, "/")
+			if len(parts) != 3 {
+				http.Error(w, fmt.Sprintf("invalid kind %q, expected group/version/resource", kind), http.StatusBadRequest)
+				return
+			}
+			filter.resources[urlResource(parts)] = true
+		}
+		sub := s.feed.subscribe(filter)
+		defer s.feed.unsubscribe(sub)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				_, err := fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+			case change, ok := <-sub.ch:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(change)
+				if err != nil {
+					logger.L().Error("cannot marshal change", helpers.Error(err))
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Type, data)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}))
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeFeed(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	srv := httptest.NewServer(s.ChangeFeedHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/watch?cluster=cluster-a&kind=core/v1/pods")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// filtered out changes
+	require.NoError(t, s.HandleAdd(newAdd("cluster-b", pods, "default/nginx", `{}`)))
+	require.NoError(t, s.HandleAdd(newAdd("cluster-a", deployments, "default/nginx", `{}`)))
+	// notified changes
+	require.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{}`)))
+	patchEvent := domain.EventPatch
+	_, err = s.HandlePatch(domain.Patch{Event: &patchEvent, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Patch: `{"a":1}`})
+	require.NoError(t, err)
+	deleteEvent := domain.EventDelete
+	require.NoError(t, s.HandleDelete(domain.Delete{Event: &deleteEvent, Cluster: "cluster-a", Kind: pods, Name: "default/nginx"}))
+
+	expected := []Change{
+		{Type: ChangeAdd, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Checksum: newChecksum("", nil, "", `{}`).Checksum},
+		{Type: ChangePatch, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Checksum: newChecksum("", nil, "", `{"a":1}`).Checksum},
+		{Type: ChangeDelete, Cluster: "cluster-a", Kind: pods, Name: "default/nginx"},
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, e := range expected {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "event: "+e.Type+"\n", line)
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		var change Change
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change))
+		assert.Equal(t, e, change)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+}
+
+func TestChangeFeedInvalidKind(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	rec := httptest.NewRecorder()
+	s.ChangeFeedHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/watch?kind=pods", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/matthyx/synchro-poc/store"
+)
+
+const lockShards = 256
+
+// keyLocks serializes the read-modify-write operations done on a given key,
+// without making unrelated keys wait on a single global lock.
+type keyLocks struct {
+	shards [lockShards]sync.Mutex
+}
+
+// lock locks the shard of key and returns the function unlocking it.
+func (l *keyLocks) lock(key store.Key) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.String()))
+	m := &l.shards[h.Sum32()%lockShards]
+	m.Lock()
+	return m.Unlock
+}
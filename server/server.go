@@ -0,0 +1,606 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/merkle"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Server handles the websocket connections of many clusters concurrently,
+// each connection being served by its own goroutine.
+type Server struct {
+	auth    *Authenticator
+	desired *desiredState
+	feed    *feed
+	hashing *hashing
+	locks   keyLocks
+	store   store.Store
+	// protocol revisions and capabilities offered to the clients
+	minProtocolVersion int
+	protocolVersion    int
+	capabilities       []string
+	// compressor compresses the messages sent to the clients advertising zstd, nil if disabled
+	compressor *domain.Compressor
+	// active connections, tracked for shutdown
+	mu      sync.Mutex
+	conns   map[*wsConn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+	// sessions are the accepted sessions by cluster, desired objects are pushed to them
+	sessions map[string]*session
+}
+
+// NewServer creates a server, authentication is disabled if auth is nil.
+func NewServer(s store.Store, auth *Authenticator) *Server {
+	return &Server{
+		auth:     auth,
+		desired:  newDesiredState(),
+		feed:     newFeed(),
+		hashing:  newHashing(),
+		store:    s,
+		conns:    map[*wsConn]struct{}{},
+		sessions: map[string]*session{},
+
+		minProtocolVersion: domain.MinProtocolVersion,
+		protocolVersion:    domain.ProtocolVersion,
+		capabilities:       append(append([]string{}, domain.Capabilities...), domain.CapabilityCBOR),
+	}
+}
+
+// UseCompression compresses the messages sent to the clients supporting it with
+// the settings of cfg, the capabilities are not advertised if disabled. It must
+// be called before serving.
+func (s *Server) UseCompression(cfg config.CompressionConfig) error {
+	capabilities := make([]string, 0, len(s.capabilities))
+	for _, c := range s.capabilities {
+		if !domain.IsCompressionCapability(c) {
+			capabilities = append(capabilities, c)
+		}
+	}
+	s.capabilities = capabilities
+	s.compressor = nil
+	if !cfg.Enabled {
+		return nil
+	}
+	compressor, err := domain.NewCompressor(cfg.Threshold, cfg.Level)
+	if err != nil {
+		return err
+	}
+	s.compressor = compressor
+	s.capabilities = append(s.capabilities, domain.CompressionCapabilities()...)
+	return nil
+}
+
+// ServeHTTP authenticates the client, upgrades the request to a websocket
+// and serves it in a goroutine.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id *identity
+	if s.auth != nil {
+		var err error
+		id, err = s.auth.Authenticate(r)
+		if err != nil {
+			logger.L().Warning("rejected connection", helpers.String("remote", r.RemoteAddr), helpers.Error(err))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// counted before upgrading, so that shutdown waits for the connection
+	s.wg.Add(1)
+	s.mu.Unlock()
+	netConn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		logger.L().Error("unable to upgrade connection", helpers.Error(err))
+		s.wg.Done()
+		return
+	}
+	conn := &wsConn{Conn: netConn}
+	s.mu.Lock()
+	closing := s.closing
+	if !closing {
+		s.conns[conn] = struct{}{}
+	}
+	s.mu.Unlock()
+	if closing {
+		// shutdown started while upgrading, it did not send a close frame to this connection
+		_ = conn.Close()
+		s.wg.Done()
+		return
+	}
+	go s.serve(conn, id)
+}
+
+// Shutdown stops accepting connections, sends a close frame to the connected
+// clients and waits for their connections to be closed, or ctx to be done.
+// Close frames are written with the deadline of ctx, if any, so that clients
+// not reading cannot block the shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	conns := s.connections()
+	s.mu.Unlock()
+	deadline, _ := ctx.Deadline()
+	for _, conn := range conns {
+		if ctx.Err() != nil {
+			break
+		}
+		err := conn.writeClose("server shutting down", deadline)
+		if err != nil {
+			logger.L().Warning("cannot send close frame", helpers.Error(err))
+		}
+	}
+	s.feed.close()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		conns = s.connections()
+		s.mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// connections returns the active connections, s.mu must be held.
+func (s *Server) connections() []*wsConn {
+	conns := make([]*wsConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (s *Server) serve(conn *wsConn, id *identity) {
+	defer func() {
+		_ = conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	sess, first, err := s.handshake(conn, id)
+	if err != nil {
+		logger.L().Error("cannot open session", helpers.Error(err))
+		return
+	}
+	s.register(sess)
+	defer s.unregister(sess)
+	s.pushPending(sess)
+	for {
+		// the first message of clients predating hello is read by the handshake
+		data := first
+		first = nil
+		if data == nil {
+			data, err = wsutil.ReadClientBinary(conn)
+			if err != nil {
+				var closedErr wsutil.ClosedError
+				if errors.As(err, &closedErr) {
+					logger.L().Info("connection closed", helpers.String("cluster", sess.cluster), helpers.Int("code", int(closedErr.Code)))
+					return
+				}
+				logger.L().Error("cannot read client data", helpers.Error(err), helpers.String("cluster", sess.cluster))
+				return
+			}
+		}
+		message, envelope, err := sess.open(data)
+		if err != nil {
+			logger.L().Error("cannot open envelope", helpers.Error(err), helpers.String("cluster", sess.cluster))
+			continue
+		}
+		if message == nil {
+			// acknowledgement of a message sent to the client
+			continue
+		}
+		resps, err := s.handleMessage(sess, message)
+		if err != nil {
+			logger.L().Error("cannot handle message", helpers.Error(err))
+		}
+		// handled messages are acknowledged even if they are invalid, sending them again would not help
+		if envelope != nil {
+			err = sess.ack(*envelope)
+			if err != nil {
+				logger.L().Error("cannot acknowledge message", helpers.Error(err))
+			}
+		}
+		for _, resp := range resps {
+			err = sess.send(resp)
+			if err != nil {
+				logger.L().Error("cannot write response", helpers.Error(err))
+				continue
+			}
+		}
+	}
+}
+
+// register makes sess the session of its cluster, replacing any previous one.
+func (s *Server) register(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.cluster] = sess
+}
+
+func (s *Server) unregister(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.cluster] == sess {
+		delete(s.sessions, sess.cluster)
+	}
+}
+
+// handleMessage dispatches a message to its handler and returns the responses
+// to send back to the client, if any.
+func (s *Server) handleMessage(sess *session, data []byte) ([]interface{}, error) {
+	var msg domain.Generic
+	err := sess.codec.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal message: %w", err)
+	}
+	if msg.Event == nil {
+		return nil, errors.New("missing event")
+	}
+	logger.L().Debug("received message", helpers.Interface("event", msg.Event.Value()))
+	err = sess.checkMessage(msg)
+	if err != nil {
+		return nil, fmt.Errorf("reject %v message: %w", msg.Event.Value(), err)
+	}
+	switch *msg.Event {
+	case domain.EventAdd:
+		var add domain.Add
+		err = sess.codec.Unmarshal(data, &add)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal add: %w", err)
+		}
+		return nil, s.HandleAdd(add)
+	case domain.EventApplyResult:
+		var result domain.ApplyResult
+		err = sess.codec.Unmarshal(data, &result)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal apply result: %w", err)
+		}
+		return nil, s.HandleApplyResult(result)
+	case domain.EventChecksum:
+		var checksum domain.Checksum
+		err = sess.codec.Unmarshal(data, &checksum)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal checksum: %w", err)
+		}
+		retrieve, err := s.HandleChecksum(checksum)
+		if retrieve == nil {
+			return nil, err
+		}
+		return []interface{}{retrieve}, err
+	case domain.EventDelete:
+		var del domain.Delete
+		err = sess.codec.Unmarshal(data, &del)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal delete: %w", err)
+		}
+		return nil, s.HandleDelete(del)
+	case domain.EventDigest:
+		var digest domain.Digest
+		err = sess.codec.Unmarshal(data, &digest)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal digest: %w", err)
+		}
+		retrieveInventory, err := s.HandleDigest(digest)
+		if retrieveInventory == nil {
+			return nil, err
+		}
+		return []interface{}{retrieveInventory}, err
+	case domain.EventInventory:
+		var inventory domain.Inventory
+		err = sess.codec.Unmarshal(data, &inventory)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal inventory: %w", err)
+		}
+		retrieves, err := s.HandleInventory(inventory)
+		resps := make([]interface{}, 0, len(retrieves))
+		for _, retrieve := range retrieves {
+			resps = append(resps, retrieve)
+		}
+		return resps, err
+	case domain.EventPatch:
+		var patch domain.Patch
+		err = sess.codec.Unmarshal(data, &patch)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal patch: %w", err)
+		}
+		updateShadow, err := s.HandlePatch(patch)
+		if updateShadow == nil {
+			return nil, err
+		}
+		return []interface{}{updateShadow}, err
+	}
+	return nil, fmt.Errorf("unexpected event %v", msg.Event.Value())
+}
+
+// HandleAdd stores the object sent by the client.
+func (s *Server) HandleAdd(add domain.Add) error {
+	key, err := objectKey(add.Cluster, add.Kind, add.Name)
+	if err != nil {
+		return err
+	}
+	defer s.locks.lock(key)()
+	logger.L().Info("adding object",
+		helpers.String("cluster", key.Cluster),
+		helpers.String("kind", add.Kind.Resource),
+		helpers.String("resource", add.Name),
+		helpers.Int("size", len(add.Object)))
+	if existingObj, err := s.store.Get(key); err == nil {
+		oldHash := s.hashing.checksum(key, existingObj.Data)
+		newHash := s.hashing.checksum(key, []byte(add.Object))
+		logger.L().Info("object already exists",
+			helpers.String("old checksum", oldHash),
+			helpers.String("new checksum", newHash))
+	}
+	err = s.store.Put(key, []byte(add.Object))
+	if err != nil {
+		return fmt.Errorf("put object: %w", err)
+	}
+	s.stored(key, ChangeAdd, []byte(add.Object))
+	return nil
+}
+
+// HandleChecksum compares the checksum sent by the client with the stored object,
+// and returns a retrieve message if they differ.
+func (s *Server) HandleChecksum(checksum domain.Checksum) (*domain.Retrieve, error) {
+	key, err := objectKey(checksum.Cluster, checksum.Kind, checksum.Name)
+	if err != nil {
+		return nil, err
+	}
+	var localChecksum string
+	object, err := s.store.Get(key)
+	switch {
+	case err == nil:
+		localChecksum = s.hashing.checksum(key, object.Data)
+	case !errors.Is(err, store.ErrNotFound):
+		return nil, fmt.Errorf("get object: %w", err)
+	}
+	if localChecksum == checksum.Checksum {
+		logger.L().Info("checksum is correct",
+			helpers.String("cluster", key.Cluster),
+			helpers.String("kind", checksum.Kind.Resource),
+			helpers.String("resource", checksum.Name),
+			helpers.String("checksum", checksum.Checksum))
+		return nil, nil
+	}
+	logger.L().Warning("checksum is wrong",
+		helpers.String("cluster", key.Cluster),
+		helpers.String("kind", checksum.Kind.Resource),
+		helpers.String("resource", checksum.Name),
+		helpers.String("local checksum", localChecksum),
+		helpers.String("remote checksum", checksum.Checksum))
+	// wrong checksum, ask for retrieve unless retrieving did not help before
+	if !s.hashing.retrieve(key, checksum.Checksum) {
+		logger.L().Warning("not retrieving object again after a checksum mismatch",
+			helpers.String("cluster", key.Cluster),
+			helpers.String("kind", checksum.Kind.Resource),
+			helpers.String("resource", checksum.Name))
+		return nil, nil
+	}
+	event := domain.EventRetrieve
+	return &domain.Retrieve{
+		Cluster: checksum.Cluster,
+		Kind:    checksum.Kind,
+		Name:    checksum.Name,
+		Event:   &event,
+	}, nil
+}
+
+// HandleDelete removes the object deleted by the client.
+func (s *Server) HandleDelete(del domain.Delete) error {
+	key, err := objectKey(del.Cluster, del.Kind, del.Name)
+	if err != nil {
+		return err
+	}
+	defer s.locks.lock(key)()
+	err = s.store.Delete(key)
+	if err != nil {
+		return fmt.Errorf("delete object: %w", err)
+	}
+	s.hashing.forget(key)
+	s.feed.publish(key, ChangeDelete, "")
+	return nil
+}
+
+// HandleDigest compares the digest sent by the client with the stored objects of a kind,
+// and returns a retrieve inventory message for the namespaces whose digests differ.
+func (s *Server) HandleDigest(digest domain.Digest) (*domain.RetrieveInventory, error) {
+	if digest.Kind == nil {
+		return nil, errors.New("missing kind")
+	}
+	resource := schema.GroupVersionResource{Group: digest.Kind.Group, Version: digest.Kind.Version, Resource: digest.Kind.Resource}
+	tree, err := s.tree(digest.Cluster, resource)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := tree.Diff(digest.Root, digest.Namespaces)
+	if len(namespaces) == 0 {
+		logger.L().Info("digest is correct",
+			helpers.String("cluster", digest.Cluster),
+			helpers.String("kind", digest.Kind.Resource),
+			helpers.String("digest", digest.Root))
+		return nil, nil
+	}
+	logger.L().Warning("digest is wrong",
+		helpers.String("cluster", digest.Cluster),
+		helpers.String("kind", digest.Kind.Resource),
+		helpers.String("local digest", tree.Root),
+		helpers.String("remote digest", digest.Root),
+		helpers.Interface("namespaces", namespaces))
+	event := domain.EventRetrieveInventory
+	return &domain.RetrieveInventory{
+		Cluster:    digest.Cluster,
+		Kind:       digest.Kind,
+		Event:      &event,
+		Namespaces: namespaces,
+	}, nil
+}
+
+// tree builds the digest tree of the stored objects of a kind.
+func (s *Server) tree(cluster string, resource schema.GroupVersionResource) (*merkle.Tree, error) {
+	keys, err := s.store.List(cluster, resource)
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	checksums := make(map[string]string, len(keys))
+	for _, key := range keys {
+		object, err := s.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get object: %w", err)
+		}
+		checksums[utils.NsNameToKey(key.Namespace, key.Name)] = s.hashing.checksum(key, object.Data)
+	}
+	return merkle.NewTree(checksums)
+}
+
+// HandleInventory reconciles the stored objects of a kind with the inventory
+// sent by the client: objects the cluster no longer has are purged, and retrieve
+// messages are returned for unknown objects or objects with a different checksum.
+// The inventory can be restricted to some namespaces.
+func (s *Server) HandleInventory(inventory domain.Inventory) ([]domain.Retrieve, error) {
+	if inventory.Kind == nil {
+		return nil, errors.New("missing kind")
+	}
+	resource := schema.GroupVersionResource{Group: inventory.Kind.Group, Version: inventory.Kind.Version, Resource: inventory.Kind.Resource}
+	keys, err := s.store.List(inventory.Cluster, resource)
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	namespaces := map[string]bool{}
+	for _, ns := range inventory.Namespaces {
+		namespaces[ns] = true
+	}
+	// purge objects deleted while the client was away
+	var purged int
+	for _, key := range keys {
+		if len(namespaces) > 0 && !namespaces[key.Namespace] {
+			continue
+		}
+		if _, ok := inventory.Checksums[utils.NsNameToKey(key.Namespace, key.Name)]; ok {
+			continue
+		}
+		unlock := s.locks.lock(key)
+		err := s.store.Delete(key)
+		if err == nil {
+			s.hashing.forget(key)
+			s.feed.publish(key, ChangeDelete, "")
+		}
+		unlock()
+		if err != nil {
+			return nil, fmt.Errorf("purge object: %w", err)
+		}
+		purged++
+	}
+	// ask for unknown or modified objects
+	var retrieves []domain.Retrieve
+	for name, checksum := range inventory.Checksums {
+		retrieve, err := s.HandleChecksum(domain.Checksum{
+			Cluster:  inventory.Cluster,
+			Kind:     inventory.Kind,
+			Name:     name,
+			Checksum: checksum,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if retrieve != nil {
+			retrieves = append(retrieves, *retrieve)
+		}
+	}
+	logger.L().Info("reconciled inventory",
+		helpers.String("cluster", inventory.Cluster),
+		helpers.String("kind", inventory.Kind.Resource),
+		helpers.Int("objects", len(inventory.Checksums)),
+		helpers.Int("purged", purged),
+		helpers.Int("retrieved", len(retrieves)))
+	return retrieves, nil
+}
+
+// HandlePatch applies the patch sent by the client to the stored object,
+// and returns an update shadow message if the patch cannot be applied.
+func (s *Server) HandlePatch(patch domain.Patch) (*domain.UpdateShadow, error) {
+	key, err := objectKey(patch.Cluster, patch.Kind, patch.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.locks.lock(key)()
+	object, err := s.store.Get(key)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("get object: %w", err)
+	}
+	// apply patch
+	modified, err := jsonpatch.MergePatch(object.Data, []byte(patch.Patch))
+	if err != nil {
+		logger.L().Error("cannot apply patch", helpers.Error(err))
+		logger.L().Debug("send update shadow", helpers.String("key", patch.Name))
+		event := domain.EventUpdateShadow
+		return &domain.UpdateShadow{
+			Cluster: patch.Cluster,
+			Kind:    patch.Kind,
+			Name:    patch.Name,
+			Event:   &event,
+			Object:  string(object.Data),
+		}, nil
+	}
+	// update in known resources
+	err = s.store.Put(key, modified)
+	if err != nil {
+		return nil, fmt.Errorf("put object: %w", err)
+	}
+	s.stored(key, ChangePatch, modified)
+	return nil, nil
+}
+
+// stored publishes the change of an object sent by the client, and reports it
+// if it was retrieved but its checksum still differs from the client's one.
+func (s *Server) stored(key store.Key, changeType string, object []byte) {
+	checksum := s.hashing.checksum(key, object)
+	s.feed.publish(key, changeType, checksum)
+	if !s.hashing.retrieved(key, checksum) {
+		s.feed.publish(key, ChangeMismatch, checksum)
+	}
+}
+
+func objectKey(cluster string, kind *domain.Kind, name string) (store.Key, error) {
+	if kind == nil {
+		return store.Key{}, errors.New("missing kind")
+	}
+	ns, n := utils.KeyToNsName(name)
+	return store.Key{
+		Cluster:   cluster,
+		Resource:  schema.GroupVersionResource{Group: kind.Group, Version: kind.Version, Resource: kind.Resource},
+		Namespace: ns,
+		Name:      n,
+	}, nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/merkle"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/matthyx/synchro-poc/utils"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	deployments = &domain.Kind{Group: "apps", Version: "v1", Resource: "deployments"}
+	pods        = &domain.Kind{Version: "v1", Resource: "pods"}
+)
+
+func newAdd(cluster string, kind *domain.Kind, name, object string) domain.Add {
+	event := domain.EventAdd
+	return domain.Add{Event: &event, Cluster: cluster, Kind: kind, Name: name, Object: object}
+}
+
+func newChecksum(cluster string, kind *domain.Kind, name, object string) domain.Checksum {
+	event := domain.EventChecksum
+	checksum, _ := utils.CanonicalHash([]byte(object))
+	return domain.Checksum{Event: &event, Cluster: cluster, Kind: kind, Name: name, Checksum: checksum}
+}
+
+func TestServerNoCollision(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	objects := []domain.Add{
+		newAdd("cluster-a", deployments, "default/nginx", `{"kind":"Deployment","cluster":"a"}`),
+		newAdd("cluster-a", pods, "default/nginx", `{"kind":"Pod","cluster":"a"}`),
+		newAdd("cluster-b", deployments, "default/nginx", `{"kind":"Deployment","cluster":"b"}`),
+		newAdd("cluster-b", pods, "default/nginx", `{"kind":"Pod","cluster":"b"}`),
+	}
+	for _, add := range objects {
+		assert.NoError(t, s.HandleAdd(add))
+	}
+	for _, add := range objects {
+		retrieve, err := s.HandleChecksum(newChecksum(add.Cluster, add.Kind, add.Name, add.Object))
+		assert.NoError(t, err)
+		assert.Nil(t, retrieve)
+	}
+	// patch only affects the targeted object
+	event := domain.EventPatch
+	updateShadow, err := s.HandlePatch(domain.Patch{Event: &event, Cluster: "cluster-b", Kind: pods, Name: "default/nginx", Patch: `{"patched":true}`})
+	assert.NoError(t, err)
+	assert.Nil(t, updateShadow)
+	retrieve, err := s.HandleChecksum(newChecksum("cluster-b", pods, "default/nginx", `{"kind":"Pod","cluster":"b","patched":true}`))
+	assert.NoError(t, err)
+	assert.Nil(t, retrieve)
+	// delete only affects the targeted object
+	delEvent := domain.EventDelete
+	assert.NoError(t, s.HandleDelete(domain.Delete{Event: &delEvent, Cluster: "cluster-a", Kind: deployments, Name: "default/nginx"}))
+	retrieve, err = s.HandleChecksum(newChecksum("cluster-a", deployments, "default/nginx", objects[0].Object))
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieve)
+	for _, add := range objects[1:3] {
+		retrieve, err := s.HandleChecksum(newChecksum(add.Cluster, add.Kind, add.Name, add.Object))
+		assert.NoError(t, err)
+		assert.Nil(t, retrieve)
+	}
+}
+
+func TestServerChecksumUnknownObject(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	retrieve, err := s.HandleChecksum(newChecksum("cluster-a", pods, "default/nginx", `{}`))
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieve)
+	assert.Equal(t, domain.EventRetrieve, *retrieve.Event)
+	assert.Equal(t, "default/nginx", retrieve.Name)
+}
+
+func TestServerPatchFailure(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := NewServer(st, nil)
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{"a":1}`)))
+	event := domain.EventPatch
+	updateShadow, err := s.HandlePatch(domain.Patch{Event: &event, Cluster: "cluster-a", Kind: pods, Name: "default/nginx", Patch: `not json`})
+	assert.NoError(t, err)
+	assert.NotNil(t, updateShadow)
+	assert.Equal(t, `{"a":1}`, updateShadow.Object)
+	object, err := st.Get(store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(object.Data))
+}
+
+func TestServerInventory(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := NewServer(st, nil)
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/same", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/modified", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/deleted", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", deployments, "default/deleted", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-b", pods, "default/deleted", `{"a":1}`)))
+	event := domain.EventInventory
+	retrieves, err := s.HandleInventory(domain.Inventory{
+		Event:   &event,
+		Cluster: "cluster-a",
+		Kind:    pods,
+		Checksums: map[string]string{
+			"default/same":     newChecksum("", nil, "", `{"a":1}`).Checksum,
+			"default/modified": newChecksum("", nil, "", `{"a":2}`).Checksum,
+			"default/unknown":  newChecksum("", nil, "", `{"a":1}`).Checksum,
+		},
+	})
+	assert.NoError(t, err)
+	var retrieved []string
+	for _, retrieve := range retrieves {
+		assert.Equal(t, "cluster-a", retrieve.Cluster)
+		retrieved = append(retrieved, retrieve.Name)
+	}
+	assert.ElementsMatch(t, []string{"default/modified", "default/unknown"}, retrieved)
+	// deleted object is purged from its own cluster and kind only
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	keys, err := st.List("cluster-a", podsResource)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	keys, err = st.List("cluster-a", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	keys, err = st.List("cluster-b", podsResource)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+}
+
+func TestServerDigest(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := NewServer(st, nil)
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/nginx", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/redis", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "kube-system/coredns", `{"a":1}`)))
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "deleted/pod", `{"a":1}`)))
+	checksum := newChecksum("", nil, "", `{"a":1}`).Checksum
+	tree, err := merkle.NewTree(map[string]string{
+		"default/nginx":       checksum,
+		"default/redis":       newChecksum("", nil, "", `{"a":2}`).Checksum,
+		"kube-system/coredns": checksum,
+	})
+	assert.NoError(t, err)
+	event := domain.EventDigest
+	retrieveInventory, err := s.HandleDigest(domain.Digest{Event: &event, Cluster: "cluster-a", Kind: pods, Root: tree.Root, Namespaces: tree.Namespaces})
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieveInventory)
+	assert.Equal(t, []string{"default", "deleted"}, retrieveInventory.Namespaces)
+	// scoped inventory only touches the requested namespaces
+	inventoryEvent := domain.EventInventory
+	retrieves, err := s.HandleInventory(domain.Inventory{
+		Event:      &inventoryEvent,
+		Cluster:    "cluster-a",
+		Kind:       pods,
+		Namespaces: retrieveInventory.Namespaces,
+		Checksums: map[string]string{
+			"default/nginx": checksum,
+			"default/redis": newChecksum("", nil, "", `{"a":2}`).Checksum,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, retrieves, 1)
+	assert.Equal(t, "default/redis", retrieves[0].Name)
+	keys, err := st.List("cluster-a", schema.GroupVersionResource{Version: "v1", Resource: "pods"})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	// once synchronized, the digest matches
+	assert.NoError(t, s.HandleAdd(newAdd("cluster-a", pods, "default/redis", `{"a":2}`)))
+	retrieveInventory, err = s.HandleDigest(domain.Digest{Event: &event, Cluster: "cluster-a", Kind: pods, Root: tree.Root, Namespaces: tree.Namespaces})
+	assert.NoError(t, err)
+	assert.Nil(t, retrieveInventory)
+}
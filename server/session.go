@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const helloTimeout = 10 * time.Second
+
+// session is the state of an accepted client connection.
+type session struct {
+	conn          *wsConn
+	identity      string
+	cluster       string
+	clientVersion string
+	resources     map[string]domain.Strategy
+	// protocolVersion and capabilities are the ones negotiated in hello, or
+	// BaselineProtocolVersion for clients predating hello
+	protocolVersion int
+	capabilities    map[string]bool
+	// codec encodes the messages following helloResponse
+	codec domain.Codec
+	// seq is the sequence number of the last envelope received, only accessed by the reader
+	seq int
+}
+
+// handshake waits for the hello message of the client and accepts or rejects the session,
+// the cluster of the session must be allowed for the authenticated identity. Clients
+// predating hello open a baseline session with their first message, which is returned
+// to be handled.
+func (s *Server) handshake(conn *wsConn, id *identity) (*session, []byte, error) {
+	err := conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	if err != nil {
+		return nil, nil, fmt.Errorf("set hello deadline: %w", err)
+	}
+	data, err := wsutil.ReadClientBinary(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read hello: %w", err)
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("reset hello deadline: %w", err)
+	}
+	var msg domain.Generic
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal hello: %w", err)
+	}
+	if msg.Event != nil && *msg.Event != domain.EventHello {
+		sess, err := s.baselineSession(msg.Cluster, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("session rejected: %w", err)
+		}
+		sess.conn = conn
+		logger.L().Info("session accepted for a client predating hello",
+			helpers.String("cluster", sess.cluster),
+			helpers.String("identity", sess.identity))
+		return sess, data, nil
+	}
+	var hello domain.Hello
+	err = json.Unmarshal(data, &hello)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal hello: %w", err)
+	}
+	sess, helloErr := s.handleHello(hello, id)
+	if sess != nil {
+		sess.conn = conn
+	}
+	event := domain.EventHelloResponse
+	resp := domain.HelloResponse{
+		Event:           &event,
+		Accepted:        helloErr == nil,
+		ServerVersion:   domain.Version,
+		ProtocolVersion: s.protocolVersion,
+	}
+	if helloErr != nil {
+		resp.Reason = helloErr.Error()
+	} else {
+		resp.ProtocolVersion = sess.protocolVersion
+		resp.Capabilities = domain.IntersectCapabilities(s.capabilities, hello.Capabilities)
+	}
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal hello response: %w", err)
+	}
+	err = conn.writeMessage(respData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("write hello response: %w", err)
+	}
+	if helloErr != nil {
+		return nil, nil, fmt.Errorf("session rejected: %w", helloErr)
+	}
+	if sess.has(domain.CapabilityZstd) {
+		conn.compressor = s.compressor.WithDictionary(domain.NegotiatedDictionary(resp.Capabilities))
+	}
+	// hash objects like the client, clients not advertising ignore paths use the defaults
+	for _, r := range hello.Resources {
+		paths := r.ChecksumIgnore
+		if paths == nil {
+			paths = utils.DefaultIgnorePaths
+		}
+		s.hashing.setIgnorePaths(sess.cluster, schema.GroupVersionResource{Group: r.Kind.Group, Version: r.Kind.Version, Resource: r.Kind.Resource}, paths)
+	}
+	logger.L().Info("session accepted",
+		helpers.String("cluster", sess.cluster),
+		helpers.String("identity", sess.identity),
+		helpers.String("client version", sess.clientVersion),
+		helpers.Int("protocol version", sess.protocolVersion),
+		helpers.Interface("capabilities", resp.Capabilities),
+		helpers.String("encoding", sess.codec.Name()),
+		helpers.Int("resources", len(sess.resources)))
+	return sess, nil, nil
+}
+
+// handleHello validates the hello message sent by the client and returns the session to open.
+func (s *Server) handleHello(hello domain.Hello, id *identity) (*session, error) {
+	if hello.Event == nil || *hello.Event != domain.EventHello {
+		return nil, errors.New("first message must be hello")
+	}
+	// minProtocolVersion defaults to protocolVersion
+	minVersion := hello.MinProtocolVersion
+	if minVersion == 0 {
+		minVersion = hello.ProtocolVersion
+	}
+	version, ok := domain.NegotiateVersion(s.minProtocolVersion, s.protocolVersion, minVersion, hello.ProtocolVersion)
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol version %d to %d, server speaks %d to %d", minVersion, hello.ProtocolVersion, s.minProtocolVersion, s.protocolVersion)
+	}
+	if hello.Cluster == "" {
+		return nil, errors.New("missing cluster")
+	}
+	if !id.allows(hello.Cluster) {
+		return nil, fmt.Errorf("%s is not allowed to synchronize cluster %q", id.name, hello.Cluster)
+	}
+	sess := &session{
+		identity:      "anonymous",
+		cluster:       hello.Cluster,
+		clientVersion: hello.ClientVersion,
+		resources:     map[string]domain.Strategy{},
+
+		protocolVersion: version,
+		capabilities:    map[string]bool{},
+	}
+	common := domain.IntersectCapabilities(s.capabilities, hello.Capabilities)
+	for _, c := range common {
+		sess.capabilities[c] = true
+	}
+	sess.codec = domain.NewCodec(version, common)
+	if id != nil {
+		sess.identity = id.name
+	}
+	for _, r := range hello.Resources {
+		if r.Kind == nil {
+			return nil, errors.New("resource without kind")
+		}
+		if !r.Strategy.IsValid() {
+			return nil, fmt.Errorf("unsupported strategy %q for %s", r.Strategy, r.Kind.String())
+		}
+		for _, path := range r.ChecksumIgnore {
+			err := utils.CheckIgnorePath(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid checksum settings for %s: %w", r.Kind.String(), err)
+			}
+		}
+		sess.resources[r.Kind.String()] = r.Strategy
+	}
+	return sess, nil
+}
+
+// baselineSession returns the session of a client predating hello, for the cluster of
+// its first message. Its resources are not declared, and it only merges patches like
+// the server it was written for.
+func (s *Server) baselineSession(cluster string, id *identity) (*session, error) {
+	if cluster == "" {
+		return nil, errors.New("missing cluster")
+	}
+	if !id.allows(cluster) {
+		return nil, fmt.Errorf("%s is not allowed to synchronize cluster %q", id.name, cluster)
+	}
+	sess := &session{
+		identity:  "anonymous",
+		cluster:   cluster,
+		resources: map[string]domain.Strategy{},
+
+		protocolVersion: domain.BaselineProtocolVersion,
+		capabilities:    map[string]bool{domain.CapabilityMergePatch: true},
+		codec:           domain.NewCodec(domain.BaselineProtocolVersion, nil),
+	}
+	if id != nil {
+		sess.identity = id.name
+	}
+	return sess, nil
+}
+
+// checkMessage verifies that a message belongs to the session.
+func (sess *session) checkMessage(msg domain.Generic) error {
+	if msg.Cluster != sess.cluster {
+		return fmt.Errorf("message for cluster %q in session of cluster %q", msg.Cluster, sess.cluster)
+	}
+	if msg.Kind == nil {
+		return errors.New("missing kind")
+	}
+	if _, ok := sess.resources[msg.Kind.String()]; !ok && !sess.baseline() {
+		return fmt.Errorf("resource %s was not declared in hello", msg.Kind.String())
+	}
+	if capability, ok := eventCapabilities[*msg.Event]; ok && !sess.has(capability) {
+		return fmt.Errorf("capability %s was not negotiated", capability)
+	}
+	return nil
+}
+
+// eventCapabilities are the capabilities required to send events.
+var eventCapabilities = map[domain.Event]string{
+	domain.EventApplyResult: domain.CapabilityApply,
+	domain.EventDigest:      domain.CapabilityDigest,
+	domain.EventPatch:       domain.CapabilityMergePatch,
+}
+
+func (sess *session) has(capability string) bool {
+	return sess.capabilities[capability]
+}
+
+// baseline tells if the client predates hello, its messages are not wrapped in envelopes.
+func (sess *session) baseline() bool {
+	return sess.protocolVersion == domain.BaselineProtocolVersion
+}
+
+// send encodes a message for the client and writes it, in an envelope if negotiated.
+func (sess *session) send(msg interface{}) error {
+	data, err := sess.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+	if sess.baseline() {
+		return sess.conn.writeMessage(data)
+	}
+	return sess.conn.send(data, sess.codec)
+}
+
+// ack acknowledges an envelope received from the client.
+func (sess *session) ack(envelope domain.Envelope) error {
+	return sess.conn.ack(envelope, sess.codec)
+}
+
+// open decompresses and unwraps the message of an envelope received from the client, the returned
+// message is nil for acknowledgements, and the envelope nil if not negotiated.
+func (sess *session) open(data []byte) ([]byte, *domain.Envelope, error) {
+	if sess.has(domain.CapabilityZstd) {
+		var err error
+		data, err = domain.Decompress(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if sess.baseline() {
+		return data, nil, nil
+	}
+	var msg domain.Generic
+	err := sess.codec.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal message: %w", err)
+	}
+	if msg.Event == nil {
+		return nil, nil, errors.New("missing event")
+	}
+	switch *msg.Event {
+	case domain.EventAck:
+		return nil, nil, nil
+	case domain.EventEnvelope:
+		var envelope domain.Envelope
+		err = sess.codec.Unmarshal(data, &envelope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unmarshal envelope: %w", err)
+		}
+		if envelope.Seq != sess.seq+1 {
+			logger.L().Warning("unexpected sequence number",
+				helpers.String("cluster", sess.cluster),
+				helpers.Int("expected", sess.seq+1),
+				helpers.Int("seq", envelope.Seq))
+		}
+		sess.seq = envelope.Seq
+		return []byte(envelope.Message), &envelope, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected %v message outside of an envelope", msg.Event.Value())
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestHelloRejected(t *testing.T) {
+	srv := httptest.NewServer(NewServer(store.NewMemoryStore(), nil))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	tests := []struct {
+		name   string
+		hello  domain.Hello
+		reason string
+	}{
+		{
+			name:   "unsupported protocol version",
+			hello:  domain.Hello{Cluster: "cluster-a", ProtocolVersion: domain.ProtocolVersion + 1},
+			reason: "unsupported protocol version",
+		},
+		{
+			name:   "missing cluster",
+			hello:  domain.Hello{ProtocolVersion: domain.ProtocolVersion},
+			reason: "missing cluster",
+		},
+		{
+			name: "unsupported strategy",
+			hello: domain.Hello{Cluster: "cluster-a", ProtocolVersion: domain.ProtocolVersion, Resources: []domain.Resource{
+				{Kind: pods, Strategy: "merge"},
+			}},
+			reason: "unsupported strategy",
+		},
+		{
+			name: "invalid checksum ignore path",
+			hello: domain.Hello{Cluster: "cluster-a", ProtocolVersion: domain.ProtocolVersion, Resources: []domain.Resource{
+				{Kind: pods, Strategy: domain.PatchStrategy, ChecksumIgnore: []string{"status"}},
+			}},
+			reason: "invalid checksum settings",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), url)
+			require.NoError(t, err)
+			defer conn.Close()
+			resp := hello(t, conn, tt.hello)
+			assert.False(t, resp.Accepted)
+			assert.Contains(t, resp.Reason, tt.reason)
+			assert.Equal(t, domain.ProtocolVersion, resp.ProtocolVersion)
+			// the connection is closed
+			_, err = wsutil.ReadServerBinary(conn)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSessionRejectsForeignMessages(t *testing.T) {
+	st := store.NewMemoryStore()
+	srv := httptest.NewServer(NewServer(st, nil))
+	defer srv.Close()
+	conn := dialSession(t, "ws"+strings.TrimPrefix(srv.URL, "http"), "cluster-a")
+	defer conn.Close()
+	services := &domain.Kind{Version: "v1", Resource: "services"}
+	send(t, conn, newAdd("cluster-b", pods, "default/foreign", `{}`))
+	send(t, conn, newAdd("cluster-a", services, "default/undeclared", `{}`))
+	send(t, conn, newAdd("cluster-a", pods, "default/nginx", `{}`))
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	assert.Eventually(t, func() bool {
+		_, err := st.Get(store.Key{Cluster: "cluster-a", Resource: podsResource, Namespace: "default", Name: "nginx"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	clusters, err := st.Clusters()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cluster-a"}, clusters)
+	resources, err := st.Resources("cluster-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{podsResource}, resources)
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn := dialSession(t, url, "cluster-a")
+	defer conn.Close()
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	// the server asks the client to close, the client library answers the close frame
+	_, err := wsutil.ReadServerBinary(conn)
+	var closedErr wsutil.ClosedError
+	require.ErrorAs(t, err, &closedErr)
+	assert.Equal(t, ws.StatusGoingAway, closedErr.Code)
+	assert.NoError(t, <-shutdown)
+	// new connections are refused
+	_, _, _, err = ws.DefaultDialer.Dial(context.Background(), url)
+	assert.Error(t, err)
+}
+
+func TestShutdownClientNotReading(t *testing.T) {
+	s := NewServer(store.NewMemoryStore(), nil)
+	// writes to a pipe block until the other end reads, which it never does
+	server, client := net.Pipe()
+	defer client.Close()
+	s.conns[&wsConn{Conn: server}] = struct{}{}
+	s.wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestSessionAcknowledgesEnvelopes(t *testing.T) {
+	st := store.NewMemoryStore()
+	srv := httptest.NewServer(NewServer(st, nil))
+	defer srv.Close()
+	conn := dialSession(t, "ws"+strings.TrimPrefix(srv.URL, "http"), "cluster-a")
+	defer conn.Close()
+	// messages outside of an envelope are ignored
+	data, err := json.Marshal(newAdd("cluster-a", pods, "default/raw", `{}`))
+	require.NoError(t, err)
+	require.NoError(t, wsutil.WriteClientBinary(conn, data))
+	send(t, conn, newAdd("cluster-a", pods, "default/nginx", `{}`))
+	data, err = wsutil.ReadServerBinary(conn)
+	require.NoError(t, err)
+	var ack domain.Ack
+	require.NoError(t, json.Unmarshal(data, &ack))
+	assert.Equal(t, domain.EventAck, *ack.Event)
+	assert.Equal(t, "1", ack.Id)
+	assert.Equal(t, 1, ack.Seq)
+	// acknowledged once handled
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	_, err = st.Get(store.Key{Cluster: "cluster-a", Resource: podsResource, Namespace: "default", Name: "nginx"})
+	assert.NoError(t, err)
+	_, err = st.Get(store.Key{Cluster: "cluster-a", Resource: podsResource, Namespace: "default", Name: "raw"})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
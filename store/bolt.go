@@ -0,0 +1,268 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthyx/synchro-poc/utils"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	boltFile        = "synchro.db"
+	valueFormat     = 1
+	valueHeaderSize = 9
+)
+
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the database file after each write transaction.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs the database file periodically.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+// BoltStore is a Store persisting objects in a bolt database, organized in
+// one bucket per cluster containing one nested bucket per resource.
+type BoltStore struct {
+	db   *bolt.DB
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ Store = (*BoltStore)(nil)
+
+// NewBoltStore opens (or creates) the database in dataDir.
+func NewBoltStore(dataDir string, policy FsyncPolicy, interval time.Duration) (*BoltStore, error) {
+	switch policy {
+	case "", FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", policy)
+	}
+	if policy == FsyncInterval && interval <= 0 {
+		return nil, errors.New("fsync interval must be positive")
+	}
+	err := os.MkdirAll(dataDir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dataDir, boltFile), 0o600, &bolt.Options{
+		Timeout: time.Second,
+		NoSync:  policy == FsyncInterval || policy == FsyncNever,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	b := &BoltStore{
+		db:   db,
+		done: make(chan struct{}),
+	}
+	if policy == FsyncInterval {
+		b.wg.Add(1)
+		go b.syncLoop(interval)
+	}
+	return b, nil
+}
+
+func (b *BoltStore) syncLoop(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = b.db.Sync()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Count walks the database and returns the number of stored objects.
+func (b *BoltStore) Count() (int, error) {
+	var count int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, cluster *bolt.Bucket) error {
+			return cluster.ForEachBucket(func(k []byte) error {
+				count += cluster.Bucket(k).Stats().KeyN
+				return nil
+			})
+		})
+	})
+	return count, err
+}
+
+func (b *BoltStore) Get(key Key) (Object, error) {
+	var object Object
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := resourceBucket(tx, key.Cluster, key.Resource)
+		if bucket == nil {
+			return ErrNotFound
+		}
+		value := bucket.Get([]byte(utils.NsNameToKey(key.Namespace, key.Name)))
+		if value == nil {
+			return ErrNotFound
+		}
+		object = decodeValue(value)
+		return nil
+	})
+	return object, err
+}
+
+func (b *BoltStore) Put(key Key, object []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		cluster, err := tx.CreateBucketIfNotExists([]byte(key.Cluster))
+		if err != nil {
+			return fmt.Errorf("create cluster bucket: %w", err)
+		}
+		bucket, err := cluster.CreateBucketIfNotExists([]byte(resourceName(key.Resource)))
+		if err != nil {
+			return fmt.Errorf("create resource bucket: %w", err)
+		}
+		return bucket.Put([]byte(utils.NsNameToKey(key.Namespace, key.Name)), encodeValue(Object{Data: object, Updated: time.Now()}))
+	})
+}
+
+// Delete removes the object, and its resource and cluster buckets once empty so
+// that they are no longer listed, like in the memory store.
+func (b *BoltStore) Delete(key Key) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := resourceBucket(tx, key.Cluster, key.Resource)
+		if bucket == nil {
+			return nil
+		}
+		err := bucket.Delete([]byte(utils.NsNameToKey(key.Namespace, key.Name)))
+		if err != nil {
+			return err
+		}
+		if k, _ := bucket.Cursor().First(); k != nil {
+			return nil
+		}
+		cluster := tx.Bucket([]byte(key.Cluster))
+		err = cluster.DeleteBucket([]byte(resourceName(key.Resource)))
+		if err != nil {
+			return fmt.Errorf("delete resource bucket: %w", err)
+		}
+		if k, _ := cluster.Cursor().First(); k != nil {
+			return nil
+		}
+		err = tx.DeleteBucket([]byte(key.Cluster))
+		if err != nil {
+			return fmt.Errorf("delete cluster bucket: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) List(cluster string, resource schema.GroupVersionResource) ([]Key, error) {
+	var keys []Key
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := resourceBucket(tx, cluster, resource)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			ns, name := utils.KeyToNsName(string(k))
+			keys = append(keys, Key{
+				Cluster:   cluster,
+				Resource:  resource,
+				Namespace: ns,
+				Name:      name,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (b *BoltStore) Clusters() ([]string, error) {
+	clusters := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			clusters = append(clusters, string(name))
+			return nil
+		})
+	})
+	return clusters, err
+}
+
+func (b *BoltStore) Resources(cluster string) ([]schema.GroupVersionResource, error) {
+	resources := []schema.GroupVersionResource{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(cluster))
+		if c == nil {
+			return nil
+		}
+		return c.ForEachBucket(func(name []byte) error {
+			parts := strings.SplitN(string(name), "/", 3)
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid resource bucket %q", name)
+			}
+			resources = append(resources, schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortResources(resources)
+	return resources, nil
+}
+
+// Close syncs the database to disk and closes it.
+func (b *BoltStore) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	err := b.db.Sync()
+	if err != nil {
+		return fmt.Errorf("sync database: %w", err)
+	}
+	return b.db.Close()
+}
+
+// encodeValue prefixes the object with a format version and its update time.
+func encodeValue(object Object) []byte {
+	value := make([]byte, valueHeaderSize+len(object.Data))
+	value[0] = valueFormat
+	binary.BigEndian.PutUint64(value[1:valueHeaderSize], uint64(object.Updated.UnixNano()))
+	copy(value[valueHeaderSize:], object.Data)
+	return value
+}
+
+// decodeValue copies the object out of value, which is only valid during the transaction.
+func decodeValue(value []byte) Object {
+	if len(value) < valueHeaderSize || value[0] != valueFormat {
+		// written before update times were stored
+		return Object{Data: append([]byte{}, value...)}
+	}
+	return Object{
+		Data:    append([]byte{}, value[valueHeaderSize:]...),
+		Updated: time.Unix(0, int64(binary.BigEndian.Uint64(value[1:valueHeaderSize]))),
+	}
+}
+
+func resourceBucket(tx *bolt.Tx, cluster string, resource schema.GroupVersionResource) *bolt.Bucket {
+	c := tx.Bucket([]byte(cluster))
+	if c == nil {
+		return nil
+	}
+	return c.Bucket([]byte(resourceName(resource)))
+}
+
+func resourceName(resource schema.GroupVersionResource) string {
+	return strings.Join([]string{resource.Group, resource.Version, resource.Resource}, "/")
+}
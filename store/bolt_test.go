@@ -0,0 +1,51 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStoreNoCollision(t *testing.T) {
+	s, err := NewBoltStore(t.TempDir(), FsyncNever, 0)
+	assert.NoError(t, err)
+	defer s.Close()
+	testNoCollision(t, s)
+}
+
+func TestBoltStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	key := Key{Cluster: "cluster-a", Resource: deployments, Namespace: "default", Name: "nginx"}
+	other := Key{Cluster: "cluster-a", Resource: deployments, Namespace: "default", Name: "redis"}
+	clusterScoped := Key{Cluster: "cluster-b", Resource: pods, Name: "node"}
+
+	s, err := NewBoltStore(dir, FsyncAlways, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(key, []byte(`{"a":1}`)))
+	assert.NoError(t, s.Put(other, []byte(`{"b":2}`)))
+	assert.NoError(t, s.Put(clusterScoped, []byte(`{"c":3}`)))
+	assert.NoError(t, s.Delete(other))
+	assert.NoError(t, s.Close())
+
+	s, err = NewBoltStore(dir, FsyncInterval, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer s.Close()
+	count, err := s.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	object, err := s.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(object.Data))
+	assert.False(t, object.Updated.IsZero())
+	_, err = s.Get(other)
+	assert.ErrorIs(t, err, ErrNotFound)
+	list, err := s.List("cluster-b", pods)
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{clusterScoped}, list)
+}
+
+func TestBoltStoreUnknownFsyncPolicy(t *testing.T) {
+	_, err := NewBoltStore(t.TempDir(), "sometimes", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type kindKey struct {
+	cluster  string
+	resource schema.GroupVersionResource
+}
+
+type objectKey struct {
+	namespace string
+	name      string
+}
+
+// MemoryStore is a Store keeping all objects in memory, safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[kindKey]map[objectKey]Object
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects: map[kindKey]map[objectKey]Object{},
+	}
+}
+
+func (m *MemoryStore) Get(key Key) (Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[kindKey{key.Cluster, key.Resource}][objectKey{key.Namespace, key.Name}]
+	if !ok {
+		return Object{}, ErrNotFound
+	}
+	return object, nil
+}
+
+func (m *MemoryStore) Put(key Key, object []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kk := kindKey{key.Cluster, key.Resource}
+	if _, ok := m.objects[kk]; !ok {
+		m.objects[kk] = map[objectKey]Object{}
+	}
+	m.objects[kk][objectKey{key.Namespace, key.Name}] = Object{Data: object, Updated: time.Now()}
+	return nil
+}
+
+func (m *MemoryStore) Delete(key Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kk := kindKey{key.Cluster, key.Resource}
+	delete(m.objects[kk], objectKey{key.Namespace, key.Name})
+	if len(m.objects[kk]) == 0 {
+		delete(m.objects, kk)
+	}
+	return nil
+}
+
+func (m *MemoryStore) List(cluster string, resource schema.GroupVersionResource) ([]Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	objects := m.objects[kindKey{cluster, resource}]
+	keys := make([]Key, 0, len(objects))
+	for ok := range objects {
+		keys = append(keys, Key{
+			Cluster:   cluster,
+			Resource:  resource,
+			Namespace: ok.namespace,
+			Name:      ok.name,
+		})
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (m *MemoryStore) Clusters() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := map[string]bool{}
+	clusters := []string{}
+	for kk := range m.objects {
+		if !seen[kk.cluster] {
+			seen[kk.cluster] = true
+			clusters = append(clusters, kk.cluster)
+		}
+	}
+	sort.Strings(clusters)
+	return clusters, nil
+}
+
+func (m *MemoryStore) Resources(cluster string) ([]schema.GroupVersionResource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	resources := []schema.GroupVersionResource{}
+	for kk := range m.objects {
+		if kk.cluster == cluster {
+			resources = append(resources, kk.resource)
+		}
+	}
+	sortResources(resources)
+	return resources, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	deployments = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	pods        = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+func TestMemoryStoreNoCollision(t *testing.T) {
+	testNoCollision(t, NewMemoryStore())
+}
+
+func testNoCollision(t *testing.T, s Store) {
+	keys := []Key{
+		{Cluster: "cluster-a", Resource: deployments, Namespace: "default", Name: "nginx"},
+		{Cluster: "cluster-a", Resource: pods, Namespace: "default", Name: "nginx"},
+		{Cluster: "cluster-b", Resource: deployments, Namespace: "default", Name: "nginx"},
+		{Cluster: "cluster-b", Resource: pods, Namespace: "default", Name: "nginx"},
+		{Cluster: "cluster-b", Resource: pods, Namespace: "kube-system", Name: "nginx"},
+	}
+	for _, key := range keys {
+		assert.NoError(t, s.Put(key, []byte(key.String())))
+	}
+	for _, key := range keys {
+		object, err := s.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, key.String(), string(object.Data))
+		assert.False(t, object.Updated.IsZero())
+	}
+	clusters, err := s.Clusters()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cluster-a", "cluster-b"}, clusters)
+	resources, err := s.Resources("cluster-b")
+	assert.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{pods, deployments}, resources)
+	list, err := s.List("cluster-b", pods)
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{keys[3], keys[4]}, list)
+	// delete only affects its own key
+	assert.NoError(t, s.Delete(keys[0]))
+	_, err = s.Get(keys[0])
+	assert.ErrorIs(t, err, ErrNotFound)
+	for _, key := range keys[1:] {
+		_, err := s.Get(key)
+		assert.NoError(t, err)
+	}
+	list, err = s.List("cluster-a", deployments)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+	// empty resources and clusters are no longer listed
+	resources, err = s.Resources("cluster-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{pods}, resources)
+	assert.NoError(t, s.Delete(keys[1]))
+	clusters, err = s.Clusters()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cluster-b"}, clusters)
+	resources, err = s.Resources("cluster-a")
+	assert.NoError(t, err)
+	assert.Empty(t, resources)
+	// deleting a missing key is not an error
+	assert.NoError(t, s.Delete(keys[1]))
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Key unambiguously identifies an object synchronized from a cluster.
+type Key struct {
+	Cluster   string
+	Resource  schema.GroupVersionResource
+	Namespace string
+	Name      string
+}
+
+func (k Key) String() string {
+	return strings.Join([]string{k.Cluster, k.Resource.Group, k.Resource.Version, k.Resource.Resource, k.Namespace, k.Name}, "/")
+}
+
+// Object is a stored object along with the time it was last updated.
+type Object struct {
+	Data    []byte
+	Updated time.Time
+}
+
+// Store holds the shadow copies of the objects received from the clusters.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	Get(key Key) (Object, error)
+	Put(key Key, object []byte) error
+	Delete(key Key) error
+	List(cluster string, resource schema.GroupVersionResource) ([]Key, error)
+	Clusters() ([]string, error)
+	Resources(cluster string) ([]schema.GroupVersionResource, error)
+	Close() error
+}
+
+func sortResources(resources []schema.GroupVersionResource) {
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].String() < resources[j].String()
+	})
+}
+
+// sortKeys sorts keys by namespace, then name.
+func sortKeys(keys []Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		return keys[i].Name < keys[j].Name
+	})
+}
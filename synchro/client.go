@@ -2,42 +2,200 @@ package synchro
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sync/atomic"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/kubescape/go-logger"
 	"github.com/kubescape/go-logger/helpers"
 	"github.com/matthyx/synchro-poc/config"
 	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/merkle"
 	"github.com/matthyx/synchro-poc/utils"
 	"github.com/panjf2000/ants/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// maxRetries is the number of times a change is retried before being
+	// dropped, it is then caught by the next resync
+	maxRetries = 5
 )
 
 type Client struct {
 	cfg       config.Config
 	client    dynamic.Interface
+	factories []dynamicinformer.DynamicSharedInformerFactory
+	fetchMode config.FetchMode
+	// ignorePaths are the paths ignored by the checksums, advertised in hello
+	ignorePaths []string
+	// informers are indexed by namespace, the informer of the empty namespace
+	// watches all namespaces
+	informers map[string]informers.GenericInformer
 	outPool   *ants.PoolWithFunc
-	res       schema.GroupVersionResource
-	resources map[string][]byte
+	pruner    *pruner
+	// queue holds the keys of the objects changed in the informer cache
+	queue    workqueue.RateLimitingInterface
+	res      schema.GroupVersionResource
+	selector *selector
+	// session holds the capabilities negotiated with the server
+	session atomic.Pointer[Session]
+	// known are the checksums last sent for each object, only accessed by the worker
+	known map[string]sentChecksum
+	// resources is the shadow of the objects sent with the patch strategy
+	resources *shadow
 	strategy  domain.Strategy
 }
 
-func NewClient(cfg config.Config, client dynamic.Interface, outPool *ants.PoolWithFunc, r config.Resource) *Client {
+// sentChecksum is the checksum sent for an object, and the resourceVersion of
+// the object hashed.
+type sentChecksum struct {
+	checksum        string
+	resourceVersion string
+}
+
+func NewClient(cfg config.Config, client dynamic.Interface, outPool *ants.PoolWithFunc, r config.Resource) (*Client, error) {
 	res := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
-	return &Client{
-		cfg:       cfg,
-		client:    client,
-		outPool:   outPool,
-		res:       res,
-		resources: map[string][]byte{},
-		strategy:  r.Strategy,
+	sel, err := newSelector(r)
+	if err != nil {
+		return nil, fmt.Errorf("create selector for %s: %w", r.String(), err)
+	}
+	p, err := newPruner(r.DropPaths(), r.Redact)
+	if err != nil {
+		return nil, fmt.Errorf("create pruner for %s: %w", r.String(), err)
+	}
+	ignorePaths, err := r.IgnorePaths()
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum ignore path for %s: %w", r.String(), err)
+	}
+	fetchMode := r.FetchMode
+	if fetchMode == "" {
+		fetchMode = config.FetchWatch
+	}
+	c := &Client{
+		cfg:         cfg,
+		client:      client,
+		fetchMode:   fetchMode,
+		ignorePaths: ignorePaths,
+		informers:   map[string]informers.GenericInformer{},
+		outPool:     outPool,
+		pruner:      p,
+		queue:       workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Name: r.String()}),
+		res:         res,
+		selector:    sel,
+		known:       map[string]sentChecksum{},
+		resources:   newShadow(),
+		strategy:    r.Strategy,
+	}
+	// one informer per namespace, or a single one for all namespaces
+	namespaces := r.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, ns := range namespaces {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, cfg.ResyncPeriod, ns, sel.tweakListOptions)
+		informer := factory.ForResource(res)
+		_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				// existing objects are sent in the digest
+				if !isInInitialList {
+					c.enqueue(obj)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				// resyncs deliver unchanged objects again
+				if unchanged(oldObj, newObj) {
+					return
+				}
+				c.enqueue(newObj)
+			},
+			DeleteFunc: c.enqueue,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("add event handler: %w", err)
+		}
+		c.factories = append(c.factories, factory)
+		c.informers[ns] = informer
+	}
+	return c, nil
+}
+
+// start starts the informers, and waits for their caches to be filled.
+func (c *Client) start(stopCh <-chan struct{}) bool {
+	var hasSynced []cache.InformerSynced
+	for _, factory := range c.factories {
+		factory.Start(stopCh)
+	}
+	for _, informer := range c.informers {
+		hasSynced = append(hasSynced, informer.Informer().HasSynced)
+	}
+	return cache.WaitForCacheSync(stopCh, hasSynced...)
+}
+
+// synced tells if the informer caches have been filled.
+func (c *Client) synced() bool {
+	for _, informer := range c.informers {
+		if !informer.Informer().HasSynced() {
+			return false
+		}
 	}
+	return true
+}
+
+// shutdown waits for the informers to stop.
+func (c *Client) shutdown() {
+	for _, factory := range c.factories {
+		factory.Shutdown()
+	}
+}
+
+// lister returns the lister of the informer watching namespace.
+func (c *Client) lister(namespace string) (cache.GenericLister, bool) {
+	if informer, ok := c.informers[namespace]; ok {
+		return informer.Lister(), true
+	}
+	if informer, ok := c.informers[metav1.NamespaceAll]; ok {
+		return informer.Lister(), true
+	}
+	return nil, false
+}
+
+// unchanged tells if an update carries the same resourceVersion of an object.
+func unchanged(oldObj, newObj interface{}) bool {
+	oldMeta, err := meta.Accessor(oldObj)
+	if err != nil {
+		return false
+	}
+	newMeta, err := meta.Accessor(newObj)
+	if err != nil {
+		return false
+	}
+	return oldMeta.GetResourceVersion() != "" && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion()
+}
+
+func (c *Client) enqueue(obj interface{}) {
+	cacheKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logger.L().Error("cannot get object key", helpers.Error(err), helpers.String("resource", c.res.Resource))
+		return
+	}
+	ns, name, err := cache.SplitMetaNamespaceKey(cacheKey)
+	if err != nil {
+		logger.L().Error("cannot split object key", helpers.Error(err), helpers.String("resource", c.res.Resource))
+		return
+	}
+	c.queue.Add(utils.NsNameToKey(ns, name))
 }
 
 func (c *Client) handleEtcdAdded(key string, newObject []byte) error {
@@ -52,49 +210,105 @@ func (c *Client) handleEtcdDeleted(key string) error {
 	}
 	if c.strategy == domain.PatchStrategy {
 		// remove from known resources
-		delete(c.resources, key)
+		c.resources.delete(key)
 	}
 	return nil
 }
 
 func (c *Client) handleEtcdModified(key string, newObject []byte) error {
 	// calculate checksum
-	checksum, _ := utils.CanonicalHash(newObject)
+	checksum, _ := c.checksum(newObject)
 	// send checksum
 	return c.sendChecksum(key, checksum)
 }
 
-func (c *Client) HandleSyncAdd(key string, newObject []byte) error {
-	if c.strategy == domain.PatchStrategy {
-		// add to known resources
-		c.resources[key] = newObject
+// HandleSyncAdd applies the object sent by the server in the namespace of key with
+// server-side apply, taking ownership of its fields, and reports the result of
+// the operation of operationID.
+func (c *Client) HandleSyncAdd(key string, newObject []byte, operationID string) error {
+	err := c.apply(key, newObject)
+	if err == nil && c.strategy == domain.PatchStrategy {
+		// the server does not store the objects it pushes, the applied object is
+		// sent in full following its watch event rather than patched from a
+		// base the server does not have
+		c.resources.delete(key)
 	}
-	// add to etcd
-	_, err := c.client.Resource(c.res).Namespace("").Create(context.Background(), &unstructured.Unstructured{Object: map[string]interface{}{}}, metav1.CreateOptions{})
-	return err
+	if !c.Session().Has(domain.CapabilityApply) {
+		return err
+	}
+	sendErr := c.sendApplyResult(key, domain.EventAdd, operationID, err)
+	if err != nil {
+		return err
+	}
+	return sendErr
 }
 
-func (c *Client) HandleSyncDelete(key string) error {
+func (c *Client) apply(key string, newObject []byte) error {
+	obj := &unstructured.Unstructured{}
+	err := obj.UnmarshalJSON(newObject)
+	if err != nil {
+		return fmt.Errorf("unmarshal object: %w", err)
+	}
+	ns, name := utils.KeyToNsName(key)
+	obj.SetNamespace(ns)
+	obj.SetName(name)
+	// the server copy is not tied to a version of the object in this cluster,
+	// and apply rejects managed fields
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+	_, err = c.client.Resource(c.res).Namespace(ns).Apply(context.Background(), name, obj, metav1.ApplyOptions{
+		FieldManager: c.cfg.FieldManager,
+		// the server is the source of truth for the objects it pushes
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("apply object: %w", err)
+	}
+	return nil
+}
+
+// HandleSyncDelete deletes the object sent by the server and reports the result
+// of the operation of operationID, an object already deleted is not an error.
+func (c *Client) HandleSyncDelete(key string, operationID string) error {
 	if c.strategy == domain.PatchStrategy {
 		// remove from known resources
-		delete(c.resources, key)
+		c.resources.delete(key)
 	}
 	// remove from etcd
-	return c.client.Resource(c.res).Namespace("").Delete(context.Background(), key, metav1.DeleteOptions{})
+	ns, name := utils.KeyToNsName(key)
+	err := c.client.Resource(c.res).Namespace(ns).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("delete object: %w", err)
+	}
+	if !c.Session().Has(domain.CapabilityApply) {
+		return err
+	}
+	sendErr := c.sendApplyResult(key, domain.EventDelete, operationID, err)
+	if err != nil {
+		return err
+	}
+	return sendErr
 }
 
 func (c *Client) HandleSyncRetrieve(key string) error {
 	ns, name := utils.KeyToNsName(key)
-	obj, err := c.client.Resource(c.res).Namespace(ns).Get(context.Background(), name, metav1.GetOptions{})
+	obj, err := c.getObject(context.Background(), ns, name)
+	if err == nil && !c.selector.matches(obj) {
+		err = apierrors.NewNotFound(c.res.GroupResource(), name)
+	}
 	if err != nil {
 		return fmt.Errorf("get resource: %w", err)
 	}
-	newObject, err := obj.MarshalJSON()
+	newObject, err := c.pruner.marshal(obj)
 	if err != nil {
 		return fmt.Errorf("marshal resource: %w", err)
 	}
-	if c.strategy == domain.PatchStrategy {
-		if oldObject, ok := c.resources[key]; ok {
+	// servers not negotiating merge patches get copies
+	if c.strategy == domain.PatchStrategy && c.Session().Has(domain.CapabilityMergePatch) {
+		if oldObject, ok := c.resources.get(key); ok {
 			// calculate patch
 			patch, err := jsonpatch.CreateMergePatch(oldObject, newObject)
 			if err != nil {
@@ -111,7 +325,7 @@ func (c *Client) HandleSyncRetrieve(key string) error {
 			}
 		}
 		// add to known resources
-		c.resources[key] = newObject
+		c.resources.put(key, newObject)
 	} else {
 		err = c.sendAdd(key, newObject)
 		if err != nil {
@@ -121,16 +335,76 @@ func (c *Client) HandleSyncRetrieve(key string) error {
 	return nil
 }
 
+// HandleSyncRetrieveInventory sends the inventory of the requested namespaces.
+func (c *Client) HandleSyncRetrieveInventory(namespaces []string) error {
+	objects := map[string][]byte{}
+	for _, ns := range namespaces {
+		nsObjects, _, err := c.listObjects(context.Background(), ns)
+		if err != nil {
+			return fmt.Errorf("list objects in namespace %s: %w", ns, err)
+		}
+		for key, object := range nsObjects {
+			// cluster-scoped objects are listed regardless of the namespace
+			if objNs, _ := utils.KeyToNsName(key); objNs == ns {
+				objects[key] = object
+			}
+		}
+	}
+	return c.sendInventory(namespaces, objects)
+}
+
 func (c *Client) HandleSyncUpdateShadow(key string, newObject []byte) error {
 	if c.strategy == domain.PatchStrategy {
 		// update in known resources
-		c.resources[key] = newObject
+		c.resources.put(key, newObject)
 		// send again
 		return c.HandleSyncRetrieve(key)
 	}
 	return nil
 }
 
+// UseSession sets the session negotiated with the server, the client only
+// uses the capabilities of the last session set.
+func (c *Client) UseSession(s Session) {
+	c.session.Store(&s)
+}
+
+// Session returns the last session set, without capabilities if none.
+func (c *Client) Session() Session {
+	s := c.session.Load()
+	if s == nil {
+		return Session{}
+	}
+	return *s
+}
+
+// encode marshals a message with the codec of the session, tagged with its name.
+func (c *Client) encode(msg interface{}) (Message, error) {
+	codec := c.Session().Codec()
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Data: data, Encoding: codec.Name()}, nil
+}
+
+// checksum hashes an object the same way as the server.
+func (c *Client) checksum(object []byte) (string, error) {
+	return utils.CanonicalHashIgnoring(object, c.ignorePaths)
+}
+
+func (c *Client) checksumObjects(objects map[string][]byte) (map[string]string, error) {
+	checksums := make(map[string]string, len(objects))
+	for key, object := range objects {
+		checksum, err := c.checksum(object)
+		if err != nil {
+			return nil, fmt.Errorf("calculate checksum of %s: %w", key, err)
+		}
+		checksums[key] = checksum
+	}
+	return checksums, nil
+}
+
 func (c *Client) sendAdd(key string, newObject []byte) error {
 	event := domain.EventAdd
 	msg := domain.Add{
@@ -144,11 +418,11 @@ func (c *Client) sendAdd(key string, newObject []byte) error {
 		Event:  &event,
 		Object: string(newObject),
 	}
-	data, err := json.Marshal(msg)
+	out, err := c.encode(msg)
 	if err != nil {
 		return fmt.Errorf("marshal add message: %w", err)
 	}
-	err = c.outPool.Invoke(data)
+	err = c.outPool.Invoke(out)
 	if err != nil {
 		return fmt.Errorf("invoke outPool on add message: %w", err)
 	}
@@ -159,6 +433,40 @@ func (c *Client) sendAdd(key string, newObject []byte) error {
 	return nil
 }
 
+func (c *Client) sendApplyResult(key string, operation domain.Event, operationID string, applyErr error) error {
+	event := domain.EventApplyResult
+	msg := domain.ApplyResult{
+		Cluster: c.cfg.Cluster,
+		Kind: &domain.Kind{
+			Group:    c.res.Group,
+			Version:  c.res.Version,
+			Resource: c.res.Resource,
+		},
+		Name:        key,
+		Event:       &event,
+		Operation:   &operation,
+		OperationId: operationID,
+		Success:     applyErr == nil,
+	}
+	if applyErr != nil {
+		msg.Reason = applyErr.Error()
+	}
+	out, err := c.encode(msg)
+	if err != nil {
+		return fmt.Errorf("marshal apply result message: %w", err)
+	}
+	err = c.outPool.Invoke(out)
+	if err != nil {
+		return fmt.Errorf("invoke outPool on apply result message: %w", err)
+	}
+	logger.L().Info("sent apply result message",
+		helpers.String("resource", c.res.Resource),
+		helpers.String("key", key),
+		helpers.Interface("operation", operation.Value()),
+		helpers.Interface("success", msg.Success))
+	return nil
+}
+
 func (c *Client) sendChecksum(key string, checksum string) error {
 	event := domain.EventChecksum
 	msg := domain.Checksum{
@@ -172,11 +480,11 @@ func (c *Client) sendChecksum(key string, checksum string) error {
 		Event:    &event,
 		Checksum: checksum,
 	}
-	data, err := json.Marshal(msg)
+	out, err := c.encode(msg)
 	if err != nil {
 		return fmt.Errorf("marshal checksum message: %w", err)
 	}
-	err = c.outPool.Invoke(data)
+	err = c.outPool.Invoke(out)
 	if err != nil {
 		return fmt.Errorf("invoke outPool on checksum message: %w", err)
 	}
@@ -199,11 +507,11 @@ func (c *Client) sendDelete(key string) error {
 		Name:  key,
 		Event: &event,
 	}
-	data, err := json.Marshal(msg)
+	out, err := c.encode(msg)
 	if err != nil {
 		return fmt.Errorf("marshal delete message: %w", err)
 	}
-	err = c.outPool.Invoke(data)
+	err = c.outPool.Invoke(out)
 	if err != nil {
 		return fmt.Errorf("invoke outPool on delete message: %w", err)
 	}
@@ -211,6 +519,68 @@ func (c *Client) sendDelete(key string) error {
 	return nil
 }
 
+func (c *Client) sendDigest(objects map[string][]byte) error {
+	checksums, err := c.checksumObjects(objects)
+	if err != nil {
+		return err
+	}
+	tree, err := merkle.NewTree(checksums)
+	if err != nil {
+		return fmt.Errorf("build digest tree: %w", err)
+	}
+	event := domain.EventDigest
+	msg := domain.Digest{
+		Cluster: c.cfg.Cluster,
+		Kind: &domain.Kind{
+			Group:    c.res.Group,
+			Version:  c.res.Version,
+			Resource: c.res.Resource,
+		},
+		Event:      &event,
+		Root:       tree.Root,
+		Namespaces: tree.Namespaces,
+	}
+	out, err := c.encode(msg)
+	if err != nil {
+		return fmt.Errorf("marshal digest message: %w", err)
+	}
+	err = c.outPool.Invoke(out)
+	if err != nil {
+		return fmt.Errorf("invoke outPool on digest message: %w", err)
+	}
+	logger.L().Info("sent digest message", helpers.String("resource", c.res.Resource), helpers.String("digest", tree.Root))
+	return nil
+}
+
+func (c *Client) sendInventory(namespaces []string, objects map[string][]byte) error {
+	checksums, err := c.checksumObjects(objects)
+	if err != nil {
+		return err
+	}
+	event := domain.EventInventory
+	msg := domain.Inventory{
+		Cluster: c.cfg.Cluster,
+		Kind: &domain.Kind{
+			Group:    c.res.Group,
+			Version:  c.res.Version,
+			Resource: c.res.Resource,
+		},
+		Event:      &event,
+		Namespaces: namespaces,
+		Checksums:  checksums,
+	}
+	out, err := c.encode(msg)
+	if err != nil {
+		return fmt.Errorf("marshal inventory message: %w", err)
+	}
+	err = c.outPool.Invoke(out)
+	if err != nil {
+		return fmt.Errorf("invoke outPool on inventory message: %w", err)
+	}
+	logger.L().Info("sent inventory message", helpers.String("resource", c.res.Resource), helpers.Int("objects", len(checksums)))
+	return nil
+}
+
 func (c *Client) sendPatch(key string, patch []byte) error {
 	event := domain.EventPatch
 	msg := domain.Patch{
@@ -224,11 +594,11 @@ func (c *Client) sendPatch(key string, patch []byte) error {
 		Event: &event,
 		Patch: string(patch),
 	}
-	data, err := json.Marshal(msg)
+	out, err := c.encode(msg)
 	if err != nil {
 		return fmt.Errorf("marshal patch message: %w", err)
 	}
-	err = c.outPool.Invoke(data)
+	err = c.outPool.Invoke(out)
 	if err != nil {
 		return fmt.Errorf("invoke outPool on patch message: %w", err)
 	}
@@ -236,82 +606,221 @@ func (c *Client) sendPatch(key string, patch []byte) error {
 	return nil
 }
 
-func (c *Client) Run() {
-	watchOpts := metav1.ListOptions{}
-	// for our storage, we need to list all resources and get them one by one
-	// as list returns objects with empty spec
-	// and watch does not return existing objects
-	if c.res.Group == "spdx.softwarecomposition.kubescape.io" {
-		list, err := c.client.Resource(c.res).Namespace("").List(context.Background(), metav1.ListOptions{})
-		if err != nil {
-			return
-		}
-		for _, d := range list.Items {
-			key := utils.NsNameToKey(d.GetNamespace(), d.GetName())
-			obj, err := c.client.Resource(c.res).Namespace(d.GetNamespace()).Get(context.Background(), d.GetName(), metav1.GetOptions{})
-			if err != nil {
-				logger.L().Error("cannot get object", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-				continue
-			}
-			newObject, err := obj.MarshalJSON()
-			if err != nil {
-				logger.L().Error("cannot marshal object", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-				continue
-			}
-			err = c.handleEtcdAdded(key, newObject)
-			if err != nil {
-				logger.L().Error("cannot handle added resource", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-				continue
-			}
-		}
-		// set resource version to watch from
-		watchOpts.ResourceVersion = list.GetResourceVersion()
+// getObject returns a complete object, from the API server if list and watch
+// return partial objects.
+func (c *Client) getObject(ctx context.Context, ns, name string) (*unstructured.Unstructured, error) {
+	if c.fetchMode == config.FetchWatch {
+		return c.getCached(ns, name)
+	}
+	return c.client.Resource(c.res).Namespace(ns).Get(ctx, name, metav1.GetOptions{})
+}
+
+// getCached returns an object from the informer cache.
+func (c *Client) getCached(ns, name string) (*unstructured.Unstructured, error) {
+	lister, ok := c.lister(ns)
+	if !ok {
+		return nil, apierrors.NewNotFound(c.res.GroupResource(), name)
+	}
+	var obj runtime.Object
+	var err error
+	if ns == "" {
+		obj, err = lister.Get(name)
+	} else {
+		obj, err = lister.ByNamespace(ns).Get(name)
 	}
-	// begin watch
-	watcher, err := c.client.Resource(c.res).Namespace("").Watch(context.Background(), watchOpts)
 	if err != nil {
-		logger.L().Fatal("unable to watch for resources", helpers.String("resource", c.res.Resource), helpers.Error(err))
+		return nil, err
+	}
+	d, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
 	}
-	for {
-		event, chanActive := <-watcher.ResultChan()
-		if !chanActive {
-			watcher.Stop()
-			break
+	return d, nil
+}
+
+// listObjects returns the objects of namespace from the informer cache, or all
+// objects if namespace is empty, and the resourceVersions of the objects returned.
+func (c *Client) listObjects(ctx context.Context, namespace string) (map[string][]byte, map[string]string, error) {
+	var list []runtime.Object
+	if namespace == "" {
+		for _, informer := range c.informers {
+			items, err := informer.Lister().List(labels.Everything())
+			if err != nil {
+				return nil, nil, fmt.Errorf("list resources: %w", err)
+			}
+			list = append(list, items...)
 		}
-		if event.Type == watch.Error {
-			logger.L().Error("watch event failed", helpers.String("resource", c.res.Resource), helpers.Interface("event", event))
-			watcher.Stop()
-			break
+	} else if lister, ok := c.lister(namespace); ok {
+		var err error
+		list, err = lister.ByNamespace(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, nil, fmt.Errorf("list resources: %w", err)
 		}
-		d, ok := event.Object.(*unstructured.Unstructured)
+	}
+	objects := make(map[string][]byte, len(list))
+	versions := make(map[string]string, len(list))
+	for _, obj := range list {
+		d, ok := obj.(*unstructured.Unstructured)
 		if !ok {
+			return nil, nil, fmt.Errorf("unexpected object type %T", obj)
+		}
+		if !c.selector.matches(d) {
 			continue
 		}
 		key := utils.NsNameToKey(d.GetNamespace(), d.GetName())
-		newObject, err := d.MarshalJSON()
-		if err != nil {
-			logger.L().Error("cannot marshal object", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		d, err := c.getObject(ctx, d.GetNamespace(), d.GetName())
+		if apierrors.IsNotFound(err) {
+			// deleted since listed
 			continue
 		}
-		switch {
-		case event.Type == watch.Added:
-			logger.L().Info("added resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			err := c.handleEtcdAdded(key, newObject)
-			if err != nil {
-				logger.L().Error("cannot handle added resource", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			}
-		case event.Type == watch.Deleted:
-			logger.L().Info("deleted resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			err := c.handleEtcdDeleted(key)
-			if err != nil {
-				logger.L().Error("cannot handle deleted resource", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			}
-		case event.Type == watch.Modified:
-			logger.L().Info("modified resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			err := c.handleEtcdModified(key, newObject)
-			if err != nil {
-				logger.L().Error("cannot handle modified resource", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
-			}
+		if err != nil {
+			return nil, nil, fmt.Errorf("get object %s: %w", key, err)
+		}
+		newObject, err := c.pruner.marshal(d)
+		if err != nil {
+			return nil, nil, fmt.Errorf("marshal object %s: %w", key, err)
+		}
+		objects[key] = newObject
+		versions[key] = d.GetResourceVersion()
+	}
+	return objects, versions, nil
+}
+
+// Resync sends the digest of the existing objects, the server will ask for the
+// objects it missed, e.g. while the client was disconnected. Nothing is sent
+// before the informer caches are filled: the server would delete the objects
+// missing from a partial digest, and Run sends the digest once they are.
+func (c *Client) Resync(ctx context.Context) error {
+	if !c.synced() {
+		logger.L().Info("informer cache not synced yet, skipping resync", helpers.String("resource", c.res.Resource))
+		return nil
+	}
+	_, _, err := c.resync(ctx)
+	return err
+}
+
+func (c *Client) resync(ctx context.Context) (map[string][]byte, map[string]string, error) {
+	objects, versions, err := c.listObjects(ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Session().Has(domain.CapabilityDigest) {
+		err = c.sendDigest(objects)
+	} else {
+		err = c.sendInventory(nil, objects)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return objects, versions, nil
+}
+
+// Run starts the informer and processes the changed objects until ctx is done.
+func (c *Client) Run(ctx context.Context) {
+	defer c.shutdown()
+	defer c.queue.ShutDown()
+	if !c.start(ctx.Done()) {
+		logger.L().Info("stopped before the informer cache synced", helpers.String("resource", c.res.Resource))
+		return
+	}
+	// send the digest of the existing objects, the server will ask for the
+	// inventory of the namespaces that differ
+	objects, versions, err := c.resync(ctx)
+	if err != nil {
+		logger.L().Error("cannot resync objects", helpers.Error(err), helpers.String("resource", c.res.Resource))
+		return
+	}
+	checksums, err := c.checksumObjects(objects)
+	if err != nil {
+		logger.L().Error("cannot calculate checksums", helpers.Error(err), helpers.String("resource", c.res.Resource))
+		return
+	}
+	for key, checksum := range checksums {
+		c.known[key] = sentChecksum{checksum: checksum, resourceVersion: versions[key]}
+	}
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNextItem(ctx) {
+	}
+	logger.L().Info("stopped watching resources", helpers.String("resource", c.res.Resource))
+}
+
+func (c *Client) processNextItem(ctx context.Context) bool {
+	item, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(item)
+	key := item.(string)
+	err := c.processKey(ctx, key)
+	switch {
+	case err == nil:
+		c.queue.Forget(item)
+	case c.queue.NumRequeues(item) < maxRetries:
+		logger.L().Warning("cannot handle resource, retrying", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		c.queue.AddRateLimited(item)
+	default:
+		logger.L().Error("cannot handle resource, dropping", helpers.Error(err), helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		c.queue.Forget(item)
+	}
+	return true
+}
+
+// processKey sends the change of an object since its checksum was last sent,
+// changes that do not alter the checksum are ignored. Objects of the version
+// whose checksum was sent are not hashed again, the cached ones may be partial.
+func (c *Client) processKey(ctx context.Context, key string) error {
+	ns, name := utils.KeyToNsName(key)
+	d, err := c.getCached(ns, name)
+	if err == nil {
+		if known, ok := c.known[key]; ok && known.resourceVersion != "" && known.resourceVersion == d.GetResourceVersion() {
+			return nil
 		}
+		if c.fetchMode == config.FetchGetOnEvent {
+			d, err = c.getObject(ctx, ns, name)
+		}
+	}
+	if err == nil && !c.selector.matches(d) {
+		// the object stopped matching the selectors, it is deleted from the server
+		err = apierrors.NewNotFound(c.res.GroupResource(), name)
 	}
+	if apierrors.IsNotFound(err) {
+		if _, ok := c.known[key]; !ok {
+			return nil
+		}
+		logger.L().Info("deleted resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		err := c.handleEtcdDeleted(key)
+		if err != nil {
+			return fmt.Errorf("handle deleted resource: %w", err)
+		}
+		delete(c.known, key)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get resource: %w", err)
+	}
+	newObject, err := c.pruner.marshal(d)
+	if err != nil {
+		return fmt.Errorf("marshal resource: %w", err)
+	}
+	checksum, err := c.checksum(newObject)
+	if err != nil {
+		return fmt.Errorf("calculate checksum: %w", err)
+	}
+	known, ok := c.known[key]
+	switch {
+	case !ok:
+		logger.L().Info("added resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		err = c.handleEtcdAdded(key, newObject)
+	case known.checksum != checksum:
+		logger.L().Info("modified resource", helpers.String("resource", c.res.Resource), helpers.String("key", key))
+		err = c.handleEtcdModified(key, newObject)
+	}
+	if err != nil {
+		return fmt.Errorf("handle changed resource: %w", err)
+	}
+	c.known[key] = sentChecksum{checksum: checksum, resourceVersion: d.GetResourceVersion()}
+	return nil
 }
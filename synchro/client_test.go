@@ -2,7 +2,11 @@ package synchro
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +19,15 @@ import (
 	"github.com/matthyx/synchro-poc/utils"
 	"github.com/panjf2000/ants/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
 )
 
 func TestClient(t *testing.T) {
@@ -28,17 +41,20 @@ func TestClient(t *testing.T) {
 	conn, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws://127.0.0.1:8080/")
 	assert.NoError(t, err)
 	defer conn.Close()
+	// open session
+	err = Handshake(conn, cfg)
+	assert.NoError(t, err)
 	// outgoing message pool
 	outPool, err := ants.NewPoolWithFunc(10, func(i interface{}) {
-		data := i.([]byte)
-		err = wsutil.WriteClientBinary(conn, data)
+		err = wsutil.WriteClientBinary(conn, i.(Message).Data)
 		if err != nil {
 			logger.L().Error("cannot send message", helpers.Error(err))
 			return
 		}
 	})
 	assert.NoError(t, err)
-	syncClient := NewClient(cfg, client, outPool, cfg.Resources[1])
+	syncClient, err := NewClient(cfg, client, outPool, cfg.Resources[1])
+	assert.NoError(t, err)
 	toto := []byte("{}")
 	err = syncClient.sendAdd("toto", toto)
 	assert.NoError(t, err)
@@ -70,3 +86,318 @@ func TestSerializeChecksum(t *testing.T) {
 		fmt.Println("checksum ok")
 	}
 }
+
+func newTestClient(t *testing.T, r config.Resource, objects ...runtime.Object) (*Client, *dynamicfake.FakeDynamicClient, chan []byte) {
+	gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gvr: "List",
+	}, objects...)
+	sent := make(chan []byte, 100)
+	outPool, err := ants.NewPoolWithFunc(1, func(i interface{}) {
+		sent <- i.(Message).Data
+	})
+	assert.NoError(t, err)
+	t.Cleanup(outPool.Release)
+	syncClient, err := NewClient(config.Config{Cluster: "kind-kind"}, client, outPool, r)
+	require.NoError(t, err)
+	syncClient.UseSession(Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: domain.Capabilities})
+	return syncClient, client, sent
+}
+
+// syncInformer starts the informer of c and waits for its cache to be filled.
+func syncInformer(t *testing.T, c *Client) {
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		c.shutdown()
+	})
+	assert.True(t, c.start(stop))
+}
+
+func newPod(ns, name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"namespace": ns,
+			"name":      name,
+		},
+	}}
+}
+
+func TestClientDigestAndInventory(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.PatchStrategy}
+	syncClient, _, sent := newTestClient(t, pods, newPod("default", "nginx"), newPod("default", "redis"), newPod("kube-system", "coredns"))
+	syncInformer(t, syncClient)
+	objects, _, err := syncClient.listObjects(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+	// digest
+	assert.NoError(t, syncClient.sendDigest(objects))
+	var digest domain.Digest
+	assert.NoError(t, json.Unmarshal(<-sent, &digest))
+	assert.Equal(t, domain.EventDigest, *digest.Event)
+	assert.Equal(t, "kind-kind", digest.Cluster)
+	assert.Equal(t, pods.String(), digest.Kind.String())
+	assert.Len(t, digest.Namespaces, 2)
+	// inventory of a single namespace
+	assert.NoError(t, syncClient.HandleSyncRetrieveInventory([]string{"default"}))
+	var inventory domain.Inventory
+	assert.NoError(t, json.Unmarshal(<-sent, &inventory))
+	assert.Equal(t, domain.EventInventory, *inventory.Event)
+	assert.Equal(t, []string{"default"}, inventory.Namespaces)
+	assert.Len(t, inventory.Checksums, 2)
+	for _, key := range []string{"default/nginx", "default/redis"} {
+		checksum, err := utils.CanonicalHash(objects[key])
+		assert.NoError(t, err)
+		assert.Equal(t, checksum, inventory.Checksums[key])
+	}
+}
+
+func TestResyncBeforeSync(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	syncClient, _, sent := newTestClient(t, pods, newPod("default", "nginx"))
+	// an empty digest would delete the objects of the server
+	require.NoError(t, syncClient.Resync(context.Background()))
+	assert.Empty(t, sent)
+	syncInformer(t, syncClient)
+	require.NoError(t, syncClient.Resync(context.Background()))
+	var digest domain.Digest
+	require.NoError(t, json.Unmarshal(<-sent, &digest))
+	assert.Equal(t, domain.EventDigest, *digest.Event)
+	assert.Len(t, digest.Namespaces, 1)
+}
+
+func TestFetchModes(t *testing.T) {
+	tests := []struct {
+		name      string
+		fetchMode config.FetchMode
+		// gets expected when listing, then on a watch event
+		listGets  int
+		eventGets int
+	}{
+		{name: "watch", fetchMode: config.FetchWatch},
+		{name: "listThenGet", fetchMode: config.FetchListThenGet, listGets: 2},
+		{name: "getOnEvent", fetchMode: config.FetchGetOnEvent, listGets: 2, eventGets: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, FetchMode: tt.fetchMode}
+			syncClient, client, sent := newTestClient(t, pods, newPod("default", "nginx"), newPod("default", "redis"))
+			// the API server returns complete objects on get only
+			var gets atomic.Int32
+			client.PrependReactor("get", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				gets.Add(1)
+				pod := newPod("default", action.(clienttesting.GetAction).GetName())
+				pod.Object["spec"] = map[string]interface{}{"nodeName": "node-1"}
+				return true, pod, nil
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				syncClient.Run(ctx)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+			assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+			assert.Equal(t, int32(tt.listGets), gets.Load())
+			objects, _, err := syncClient.listObjects(ctx, "")
+			require.NoError(t, err)
+			assert.Equal(t, tt.fetchMode != config.FetchWatch, strings.Contains(string(objects["default/nginx"]), "node-1"))
+			// watch event
+			gets.Store(0)
+			require.NoError(t, client.Tracker().Add(newPod("default", "mysql")))
+			assert.Equal(t, [][2]string{{"checksum", "default/mysql"}}, nextMessages(t, sent, 1))
+			assert.Equal(t, int32(tt.eventGets), gets.Load())
+		})
+	}
+}
+
+// TestResyncUnchanged checks that objects whose checksum was sent are not
+// hashed or fetched again when the informer delivers them unchanged.
+func TestResyncUnchanged(t *testing.T) {
+	for _, fetchMode := range []config.FetchMode{config.FetchWatch, config.FetchListThenGet, config.FetchGetOnEvent} {
+		t.Run(string(fetchMode), func(t *testing.T) {
+			pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, FetchMode: fetchMode}
+			nginx := newPod("default", "nginx")
+			nginx.SetResourceVersion("1")
+			syncClient, client, sent := newTestClient(t, pods, nginx)
+			// the API server returns complete objects on get only
+			var gets atomic.Int32
+			client.PrependReactor("get", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				gets.Add(1)
+				pod := newPod("default", action.(clienttesting.GetAction).GetName())
+				pod.SetResourceVersion("1")
+				pod.Object["spec"] = map[string]interface{}{"nodeName": "node-1"}
+				return true, pod, nil
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				syncClient.Run(ctx)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+			assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+			gets.Store(0)
+			// as enqueued by a resync, nothing is sent
+			syncClient.queue.Add("default/nginx")
+			require.NoError(t, client.Tracker().Add(newPod("default", "mysql")))
+			assert.Equal(t, [][2]string{{"checksum", "default/mysql"}}, nextMessages(t, sent, 1))
+			if fetchMode == config.FetchGetOnEvent {
+				assert.Equal(t, int32(1), gets.Load())
+			} else {
+				assert.Zero(t, gets.Load())
+			}
+		})
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	pod := newPod("default", "nginx")
+	pod.SetResourceVersion("1")
+	modified := pod.DeepCopy()
+	modified.SetResourceVersion("2")
+	assert.True(t, unchanged(pod, pod.DeepCopy()))
+	assert.False(t, unchanged(pod, modified))
+	// objects without resourceVersion are compared
+	assert.False(t, unchanged(newPod("default", "nginx"), newPod("default", "nginx")))
+	assert.False(t, unchanged("default/nginx", pod))
+}
+
+// applyReactor emulates server-side apply, which the fake client implements
+// as a strategic merge patch of an existing object.
+func applyReactor(t *testing.T, client *dynamicfake.FakeDynamicClient, gvr schema.GroupVersionResource) {
+	client.PrependReactor("patch", gvr.Resource, func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clienttesting.PatchAction)
+		require.Equal(t, types.ApplyPatchType, patch.GetPatchType())
+		obj := &unstructured.Unstructured{}
+		err := obj.UnmarshalJSON(patch.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+		_, err = client.Tracker().Get(gvr, patch.GetNamespace(), patch.GetName())
+		if apierrors.IsNotFound(err) {
+			return true, obj, client.Tracker().Create(gvr, obj, patch.GetNamespace())
+		}
+		return true, obj, client.Tracker().Update(gvr, obj, patch.GetNamespace())
+	})
+}
+
+// nextApplyResult returns the next apply result message sent.
+func nextApplyResult(t *testing.T, sent chan []byte) domain.ApplyResult {
+	select {
+	case data := <-sent:
+		var result domain.ApplyResult
+		require.NoError(t, json.Unmarshal(data, &result))
+		require.Equal(t, domain.EventApplyResult, *result.Event)
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply result not sent")
+	}
+	return domain.ApplyResult{}
+}
+
+func TestHandleSyncAdd(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.PatchStrategy}
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	existing := newPod("default", "redis")
+	existing.SetLabels(map[string]string{"app": "cache"})
+	syncClient, client, sent := newTestClient(t, pods, existing)
+	applyReactor(t, client, podsResource)
+	// sent before the server pushed its copy
+	syncClient.resources.put("default/redis", []byte(`{"metadata":{"name":"redis","labels":{"app":"cache"}}}`))
+	tests := []struct {
+		name    string
+		key     string
+		object  string
+		wantErr bool
+		labels  map[string]string
+	}{
+		{
+			name:   "create in the namespace of the key",
+			key:    "default/nginx",
+			object: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx","labels":{"app":"web"}}}`,
+			labels: map[string]string{"app": "web"},
+		},
+		{
+			name:   "update existing object",
+			key:    "default/redis",
+			object: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"redis","resourceVersion":"42","labels":{"app":"db"}}}`,
+			labels: map[string]string{"app": "db"},
+		},
+		{
+			name:    "invalid object",
+			key:     "default/invalid",
+			object:  `{"metadata":{"name":"invalid"}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := syncClient.HandleSyncAdd(tt.key, []byte(tt.object), tt.name)
+			result := nextApplyResult(t, sent)
+			assert.Equal(t, tt.key, result.Name)
+			assert.Equal(t, domain.EventAdd, *result.Operation)
+			assert.Equal(t, tt.name, result.OperationId)
+			assert.Equal(t, !tt.wantErr, result.Success)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.NotEmpty(t, result.Reason)
+				_, ok := syncClient.resources.get(tt.key)
+				assert.False(t, ok)
+				return
+			}
+			require.NoError(t, err)
+			ns, name := utils.KeyToNsName(tt.key)
+			obj, err := client.Resource(podsResource).Namespace(ns).Get(context.Background(), name, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.labels, obj.GetLabels())
+			// the object is sent in full on its next retrieval
+			_, ok := syncClient.resources.get(tt.key)
+			assert.False(t, ok)
+		})
+	}
+	syncInformer(t, syncClient)
+	require.NoError(t, syncClient.HandleSyncRetrieve("default/redis"))
+	assert.Equal(t, [][2]string{{"add", "default/redis"}}, nextMessages(t, sent, 1))
+}
+
+func TestHandleSyncAddReportsFailure(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	syncClient, client, sent := newTestClient(t, pods)
+	client.PrependReactor("patch", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "nginx", errors.New("field manager conflict"))
+	})
+	err := syncClient.HandleSyncAdd("default/nginx", []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"}}`), "1")
+	assert.Error(t, err)
+	result := nextApplyResult(t, sent)
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Reason, "field manager conflict")
+}
+
+func TestHandleSyncDelete(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.PatchStrategy}
+	podsResource := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	syncClient, client, sent := newTestClient(t, pods, newPod("default", "nginx"))
+	syncClient.resources.put("default/nginx", []byte(`{}`))
+	for _, key := range []string{"default/nginx", "default/unknown"} {
+		// deleting an object already gone is not an error
+		require.NoError(t, syncClient.HandleSyncDelete(key, "1"))
+		result := nextApplyResult(t, sent)
+		assert.Equal(t, key, result.Name)
+		assert.Equal(t, "1", result.OperationId)
+		assert.Equal(t, domain.EventDelete, *result.Operation)
+		assert.True(t, result.Success, result.Reason)
+	}
+	_, err := client.Resource(podsResource).Namespace("default").Get(context.Background(), "nginx", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, ok := syncClient.resources.get("default/nginx")
+	assert.False(t, ok)
+}
@@ -0,0 +1,199 @@
+package synchro
+
+import (
+	"context"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/server"
+	"github.com/matthyx/synchro-poc/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// TestConnCompatibility connects clients offering different revisions and
+// capabilities to the current server.
+func TestConnCompatibility(t *testing.T) {
+	tests := []struct {
+		name    string
+		offer   offer
+		session Session
+	}{
+		{
+			name:    "client without capabilities",
+			offer:   offer{minProtocolVersion: domain.ProtocolVersion, protocolVersion: domain.ProtocolVersion},
+			session: Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: []string{}},
+		},
+		{
+			name:    "future client",
+			offer:   offer{minProtocolVersion: domain.ProtocolVersion, protocolVersion: domain.ProtocolVersion + 1, capabilities: []string{"batching"}},
+			session: Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: []string{}},
+		},
+		{
+			name:    "current client",
+			offer:   newOffer(config.Config{Encoding: domain.EncodingJSON}),
+			session: Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: domain.Capabilities},
+		},
+		{
+			name:    "current client encoding cbor",
+			offer:   newOffer(config.Config{Encoding: domain.EncodingCBOR}),
+			session: Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: append(append([]string{}, domain.Capabilities...), domain.CapabilityCBOR)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemoryStore()
+			srv := httptest.NewServer(server.NewServer(st, nil))
+			defer srv.Close()
+			cfg := config.Config{
+				Cluster:    "cluster-a",
+				Server:     "ws" + strings.TrimPrefix(srv.URL, "http"),
+				Resources:  []config.Resource{{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}},
+				Reconnect:  config.ReconnectConfig{InitialInterval: 10 * time.Millisecond, MaxInterval: 100 * time.Millisecond},
+				AckTimeout: time.Second,
+			}
+			conn := NewConn(cfg, ws.Dialer{})
+			conn.offer = tt.offer
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			connected := make(chan struct{}, 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				conn.Run(ctx, func([]byte) {}, func() {
+					connected <- struct{}{}
+				})
+			}()
+			select {
+			case <-connected:
+			case <-time.After(5 * time.Second):
+				t.Fatal("not connected")
+			}
+			assert.Equal(t, tt.session, conn.Session())
+			event := domain.EventAdd
+			data, err := tt.session.Codec().Marshal(domain.Add{Event: &event, Cluster: "cluster-a", Kind: &domain.Kind{Version: "v1", Resource: "pods"}, Name: "default/nginx", Object: "{}"})
+			require.NoError(t, err)
+			require.NoError(t, conn.Write(Message{Data: data, Encoding: tt.session.Codec().Name()}))
+			key := store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+			assert.Eventually(t, func() bool {
+				_, err := st.Get(key)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			// the outbox is emptied by the acknowledgement
+			assert.Eventually(t, func() bool {
+				return conn.outbox.len() == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			cancel()
+			assert.NoError(t, conn.Close(5*time.Second))
+			<-done
+		})
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.PatchStrategy}
+	syncClient, _, sent := newTestClient(t, pods, newPod("default", "nginx"))
+	syncInformer(t, syncClient)
+	syncClient.UseSession(Session{ProtocolVersion: 1})
+	// inventory instead of digest
+	require.NoError(t, syncClient.Resync(context.Background()))
+	assert.Equal(t, [][2]string{{"inventory", ""}}, nextMessages(t, sent, 1))
+	// copies instead of patches
+	syncClient.resources.put("default/nginx", []byte(`{}`))
+	require.NoError(t, syncClient.HandleSyncRetrieve("default/nginx"))
+	assert.Equal(t, [][2]string{{"add", "default/nginx"}}, nextMessages(t, sent, 1))
+	// no apply result
+	require.NoError(t, syncClient.HandleSyncDelete("default/nginx", "1"))
+	select {
+	case data := <-sent:
+		t.Fatalf("unexpected message %s", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	syncClient.UseSession(Session{ProtocolVersion: domain.ProtocolVersion, Capabilities: domain.Capabilities})
+	require.NoError(t, syncClient.Resync(context.Background()))
+	assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+}
+
+func TestConnCompression(t *testing.T) {
+	st := store.NewMemoryStore()
+	s := server.NewServer(st, nil)
+	compression := config.CompressionConfig{Enabled: true, Threshold: 1 << 10, Level: domain.DefaultCompressionLevel}
+	require.NoError(t, s.UseCompression(compression))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	cfg := config.Config{
+		Cluster:     "cluster-a",
+		Server:      "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Resources:   []config.Resource{{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}},
+		Reconnect:   config.ReconnectConfig{InitialInterval: 10 * time.Millisecond, MaxInterval: 100 * time.Millisecond},
+		AckTimeout:  time.Second,
+		Encoding:    domain.EncodingCBOR,
+		Compression: compression,
+	}
+	conn := NewConn(cfg, ws.Dialer{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 1)
+	received := make(chan []byte, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Run(ctx, func(data []byte) {
+			received <- data
+		}, func() {
+			connected <- struct{}{}
+		})
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+	session := conn.Session()
+	assert.True(t, session.Has(domain.CapabilityZstd))
+	// with the shared dictionary
+	assert.Equal(t, uint32(32768), domain.NegotiatedDictionary(session.Capabilities))
+	compressed := func() int64 {
+		if v, ok := domain.CompressionMetrics.Get("compressed").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	sent := compressed()
+
+	// large objects are compressed by the client
+	object := `{"data":"` + strings.Repeat("synchro", 1<<12) + `"}`
+	event := domain.EventAdd
+	data, err := session.Codec().Marshal(domain.Add{Event: &event, Cluster: "cluster-a", Kind: &domain.Kind{Version: "v1", Resource: "pods"}, Name: "default/nginx", Object: object})
+	require.NoError(t, err)
+	require.NoError(t, conn.Write(Message{Data: data, Encoding: session.Codec().Name()}))
+	key := store.Key{Cluster: "cluster-a", Resource: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, Namespace: "default", Name: "nginx"}
+	assert.Eventually(t, func() bool {
+		stored, err := st.Get(key)
+		return err == nil && string(stored.Data) == object
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Greater(t, compressed(), sent)
+
+	// and by the server
+	sent = compressed()
+	require.NoError(t, s.PutDesired(key, []byte(object)))
+	select {
+	case data := <-received:
+		var add domain.Add
+		require.NoError(t, session.Codec().Unmarshal(data, &add))
+		assert.Equal(t, object, add.Object)
+	case <-time.After(5 * time.Second):
+		t.Fatal("desired object not received")
+	}
+	assert.Greater(t, compressed(), sent)
+	cancel()
+	assert.NoError(t, conn.Close(5*time.Second))
+	<-done
+}
@@ -0,0 +1,424 @@
+package synchro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+)
+
+const (
+	defaultAckTimeout = 10 * time.Second
+	// helloTimeout bounds the wait for the response to hello
+	helloTimeout = 10 * time.Second
+)
+
+// Conn is a websocket connection to the server that is re-dialed with
+// exponential backoff and jitter whenever it is lost. Messages are wrapped in
+// envelopes and kept in an outbox until the server acknowledges them.
+type Conn struct {
+	cfg        config.Config
+	dialer     ws.Dialer
+	backOff    backoff.BackOff
+	ackTimeout time.Duration
+	// helloTimeout bounds the handshake of each connection
+	helloTimeout time.Duration
+	offer        offer
+	outbox       *outbox
+	// compressor compresses the messages sent once zstd is negotiated, nil if disabled
+	compressor *domain.Compressor
+	// mu guards conn, session, closing and seq, and serializes writes
+	mu      sync.Mutex
+	conn    net.Conn
+	session Session
+	closing bool
+	// seq is the sequence number of the last envelope sent on conn
+	seq  int
+	done chan struct{}
+}
+
+func NewConn(cfg config.Config, dialer ws.Dialer) *Conn {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = cfg.Reconnect.InitialInterval
+	b.MaxInterval = cfg.Reconnect.MaxInterval
+	b.RandomizationFactor = 0.5
+	// retry forever
+	b.MaxElapsedTime = 0
+	ackTimeout := cfg.AckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckTimeout
+	}
+	c := &Conn{
+		cfg:          cfg,
+		dialer:       dialer,
+		backOff:      b,
+		ackTimeout:   ackTimeout,
+		offer:        newOffer(cfg),
+		helloTimeout: helloTimeout,
+		outbox:       newOutbox(),
+		done:         make(chan struct{}),
+	}
+	if cfg.Compression.Enabled {
+		compressor, err := domain.NewCompressor(cfg.Compression.Threshold, cfg.Compression.Level)
+		if err != nil {
+			logger.L().Error("cannot create compressor, compression is disabled", helpers.Error(err))
+		} else {
+			c.compressor = compressor
+			c.offer.capabilities = append(append([]string{}, c.offer.capabilities...), domain.CompressionCapabilities()...)
+		}
+	}
+	return c
+}
+
+// Message is a message to send to the server, and the name of the codec that
+// encoded it, empty if unknown.
+type Message struct {
+	Data     []byte
+	Encoding string
+}
+
+// Write queues a message in the outbox and sends it if connected, it is sent
+// again until acknowledged by the server, also after a reconnection. Messages
+// encoded by the codec of another session are dropped.
+func (c *Conn) Write(msg Message) error {
+	c.outbox.add(msg.Data, msg.Encoding)
+	return c.flush()
+}
+
+// flush sends the messages of the outbox never sent on the current connection,
+// or not acknowledged in time.
+func (c *Conn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	codec := c.session.Codec()
+	for _, msg := range c.outbox.due(time.Now(), c.ackTimeout) {
+		if msg.encoding != "" && msg.encoding != codec.Name() {
+			// encoded before the session changed, the server is resynced once the outbox drains
+			c.outbox.drop(msg.id)
+			logger.L().Warning("dropping message encoded for another session", helpers.String("id", msg.id), helpers.String("encoding", msg.encoding))
+			continue
+		}
+		c.seq++
+		event := domain.EventEnvelope
+		data, err := codec.Marshal(domain.Envelope{
+			Event:   &event,
+			Id:      msg.id,
+			Seq:     c.seq,
+			Message: string(msg.data),
+		})
+		if err != nil {
+			return fmt.Errorf("marshal envelope: %w", err)
+		}
+		err = c.write(data)
+		if err != nil {
+			return fmt.Errorf("write message: %w", err)
+		}
+	}
+	return nil
+}
+
+// write sends a message on the current connection, compressed if negotiated with
+// the most recent shared dictionary, c.mu must be held.
+func (c *Conn) write(data []byte) error {
+	if c.session.Has(domain.CapabilityZstd) {
+		data = c.compressor.WithDictionary(domain.NegotiatedDictionary(c.session.Capabilities)).Compress(data)
+	}
+	return wsutil.WriteClientBinary(c.conn, data)
+}
+
+// retransmit sends the unacknowledged messages again until stop is closed.
+func (c *Conn) retransmit(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.ackTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := c.flush()
+			if err != nil {
+				logger.L().Warning("cannot send messages again", helpers.Error(err))
+			}
+		}
+	}
+}
+
+// Run dials the server and passes incoming messages to handle, until ctx is
+// done or Close is called. onConnect is called after each successful handshake,
+// it is expected to resync the state lost while disconnected. It is called again
+// once the outbox drains after unacknowledged messages were dropped.
+func (c *Conn) Run(ctx context.Context, handle func(data []byte), onConnect func()) {
+	defer close(c.done)
+	for {
+		conn, err := c.connect(ctx)
+		if err != nil {
+			// ctx is done or Close was called
+			return
+		}
+		err = c.flush()
+		if err != nil {
+			logger.L().Warning("cannot send queued messages", helpers.Error(err))
+		}
+		onConnect()
+		stop := make(chan struct{})
+		go c.retransmit(stop)
+		c.read(conn, handle, onConnect)
+		close(stop)
+		c.mu.Lock()
+		c.conn = nil
+		closing := c.closing
+		c.mu.Unlock()
+		_ = conn.Close()
+		if closing || ctx.Err() != nil {
+			return
+		}
+		logger.L().Warning("connection lost, reconnecting")
+	}
+}
+
+// connect dials the server and opens a session, retrying with backoff.
+func (c *Conn) connect(ctx context.Context) (net.Conn, error) {
+	c.backOff.Reset()
+	var conn net.Conn
+	var session *Session
+	err := backoff.RetryNotify(func() error {
+		if c.isClosing() {
+			return backoff.Permanent(errors.New("connection closed"))
+		}
+		var err error
+		conn, _, _, err = c.dialer.Dial(ctx, c.cfg.Server)
+		if err != nil {
+			return fmt.Errorf("dial server: %w", err)
+		}
+		session, err = c.open(ctx, conn)
+		if err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("open session: %w", err)
+		}
+		return nil
+	}, backoff.WithContext(c.backOff, ctx), func(err error, next time.Duration) {
+		logger.L().Warning("cannot connect to server", helpers.Error(err), helpers.String("retry in", next.String()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		_ = conn.Close()
+		return nil, errors.New("connection closed")
+	}
+	c.conn = conn
+	// messages queued for another encoding cannot be decoded by the server, the
+	// resync following the connection replaces them
+	if dropped := c.outbox.retain(session.Codec().Name()); dropped > 0 {
+		logger.L().Warning("encoding changed, dropping unacknowledged messages", helpers.Int("count", dropped))
+	}
+	c.session = *session
+	c.seq = 0
+	// unacknowledged messages are sent again on the new connection
+	c.outbox.reset()
+	logger.L().Info("connected to server",
+		helpers.String("server", c.cfg.Server),
+		helpers.Int("protocol version", session.ProtocolVersion),
+		helpers.Interface("capabilities", session.Capabilities),
+		helpers.String("encoding", session.Codec().Name()))
+	return conn, nil
+}
+
+// open runs the handshake on conn, it fails if the server does not answer within
+// helloTimeout or ctx is done.
+func (c *Conn) open(ctx context.Context, conn net.Conn) (*Session, error) {
+	err := conn.SetDeadline(time.Now().Add(c.helloTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("set hello deadline: %w", err)
+	}
+	// expire the deadline to unblock the handshake when ctx is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	session, err := handshake(conn, c.cfg, c.offer)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("reset hello deadline: %w", err)
+	}
+	return session, nil
+}
+
+func (c *Conn) read(conn net.Conn, handle func(data []byte), resync func()) {
+	for {
+		// control frames are answered through lockedWriter, not to interleave with Write
+		data, err := wsutil.ReadServerBinary(struct {
+			io.Reader
+			io.Writer
+		}{conn, lockedWriter{conn: conn, mu: &c.mu}})
+		if err != nil {
+			var closedErr wsutil.ClosedError
+			if errors.As(err, &closedErr) {
+				logger.L().Info("connection closed", helpers.Int("code", int(closedErr.Code)), helpers.String("reason", closedErr.Reason))
+				return
+			}
+			logger.L().Error("cannot read server data", helpers.Error(err))
+			return
+		}
+		err = c.receive(data, handle, resync)
+		if err != nil {
+			logger.L().Error("cannot receive server message", helpers.Error(err))
+		}
+	}
+}
+
+// receive decompresses and passes the message of an envelope to handle and acknowledges it,
+// and removes the messages acknowledged by the server from the outbox. resync is called
+// once the outbox drains after messages were dropped, the server missed them.
+func (c *Conn) receive(data []byte, handle func(data []byte), resync func()) error {
+	session := c.Session()
+	if session.Has(domain.CapabilityZstd) {
+		var err error
+		data, err = domain.Decompress(data)
+		if err != nil {
+			return err
+		}
+	}
+	codec := session.Codec()
+	var msg domain.Generic
+	err := codec.Unmarshal(data, &msg)
+	if err != nil {
+		return fmt.Errorf("unmarshal message: %w", err)
+	}
+	if msg.Event == nil {
+		return errors.New("missing event")
+	}
+	switch *msg.Event {
+	case domain.EventAck:
+		var ack domain.Ack
+		err = codec.Unmarshal(data, &ack)
+		if err != nil {
+			return fmt.Errorf("unmarshal ack: %w", err)
+		}
+		if !c.outbox.ack(ack.Id) {
+			logger.L().Debug("ignoring acknowledgement of unknown message", helpers.String("id", ack.Id))
+		}
+		if c.outbox.resyncDue() {
+			logger.L().Info("unacknowledged messages were dropped, resyncing")
+			resync()
+		}
+		return nil
+	case domain.EventEnvelope:
+		var envelope domain.Envelope
+		err = codec.Unmarshal(data, &envelope)
+		if err != nil {
+			return fmt.Errorf("unmarshal envelope: %w", err)
+		}
+		handle([]byte(envelope.Message))
+		event := domain.EventAck
+		ackData, err := codec.Marshal(domain.Ack{Event: &event, Id: envelope.Id, Seq: envelope.Seq})
+		if err != nil {
+			return fmt.Errorf("marshal ack: %w", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn == nil {
+			return nil
+		}
+		return c.write(ackData)
+	}
+	return fmt.Errorf("unexpected %v message outside of an envelope", msg.Event.Value())
+}
+
+type lockedWriter struct {
+	conn net.Conn
+	mu   *sync.Mutex
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.Write(p)
+}
+
+// Session returns the session negotiated on the last connection.
+func (c *Conn) Session() Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+func (c *Conn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// Close waits for the messages of the outbox to be acknowledged if connected,
+// then sends a close frame and waits for the server to acknowledge it, all within
+// timeout. Run returns once the connection is closed.
+func (c *Conn) Close(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c.mu.Lock()
+	connected := c.conn != nil
+	c.mu.Unlock()
+	if connected {
+		select {
+		case <-c.outbox.drained():
+		case <-time.After(timeout):
+		}
+	}
+	if pending := c.outbox.len(); pending > 0 {
+		logger.L().Warning("closing with unacknowledged messages", helpers.Int("count", pending))
+	}
+	if c.compressor != nil {
+		logger.L().Info("compression metrics", helpers.String("metrics", domain.CompressionMetrics.String()))
+	}
+	c.mu.Lock()
+	c.closing = true
+	conn := c.conn
+	var err error
+	if conn != nil {
+		err = wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, "shutting down"))
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("send close frame: %w", err)
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(time.Until(deadline)):
+		_ = conn.Close()
+		return errors.New("server did not acknowledge close frame")
+	}
+}
@@ -0,0 +1,340 @@
+package synchro
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnReconnects(t *testing.T) {
+	var sessions atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// accept the session
+		_, err = wsutil.ReadClientBinary(conn)
+		if err != nil {
+			return
+		}
+		event := domain.EventHelloResponse
+		data, _ := json.Marshal(domain.HelloResponse{Event: &event, Accepted: true, ProtocolVersion: domain.ProtocolVersion})
+		_ = wsutil.WriteServerBinary(conn, data)
+		// drop the first connection, echo messages on the next ones
+		if sessions.Add(1) == 1 {
+			return
+		}
+		for {
+			data, err := wsutil.ReadClientBinary(conn)
+			if err != nil {
+				return
+			}
+			_ = wsutil.WriteServerBinary(conn, data)
+		}
+	}))
+	defer srv.Close()
+	cfg := config.Config{
+		Cluster: "cluster-a",
+		Server:  "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Reconnect: config.ReconnectConfig{
+			InitialInterval: 10 * time.Millisecond,
+			MaxInterval:     100 * time.Millisecond,
+		},
+		AckTimeout: time.Second,
+	}
+	conn := NewConn(cfg, ws.Dialer{})
+	// messages written while disconnected are queued
+	require.NoError(t, conn.Write(Message{Data: []byte("queued")}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 2)
+	received := make(chan []byte, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Run(ctx, func(data []byte) {
+			received <- data
+		}, func() {
+			connected <- struct{}{}
+		})
+	}()
+	// onConnect is called again after the reconnection
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not connected")
+		}
+	}
+	require.NoError(t, conn.Write(Message{Data: []byte("hello")}))
+	for _, expected := range []string{"queued", "hello"} {
+		select {
+		case data := <-received:
+			assert.Equal(t, expected, string(data))
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not echoed")
+		}
+	}
+	// the echoed envelopes are acknowledged, and their acknowledgements echoed back
+	assert.Eventually(t, func() bool {
+		return conn.outbox.len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, conn.Close(5*time.Second))
+	<-done
+}
+
+func TestConnRetransmits(t *testing.T) {
+	envelopes := make(chan domain.Envelope, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = wsutil.ReadClientBinary(conn)
+		if err != nil {
+			return
+		}
+		event := domain.EventHelloResponse
+		data, _ := json.Marshal(domain.HelloResponse{Event: &event, Accepted: true, ProtocolVersion: domain.ProtocolVersion})
+		_ = wsutil.WriteServerBinary(conn, data)
+		// acknowledge the second transmission only
+		for i := 0; ; i++ {
+			data, err := wsutil.ReadClientBinary(conn)
+			if err != nil {
+				return
+			}
+			var envelope domain.Envelope
+			_ = json.Unmarshal(data, &envelope)
+			envelopes <- envelope
+			if i > 0 {
+				event := domain.EventAck
+				data, _ = json.Marshal(domain.Ack{Event: &event, Id: envelope.Id, Seq: envelope.Seq})
+				_ = wsutil.WriteServerBinary(conn, data)
+			}
+		}
+	}))
+	defer srv.Close()
+	cfg := config.Config{
+		Cluster:    "cluster-a",
+		Server:     "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Reconnect:  config.ReconnectConfig{InitialInterval: 10 * time.Millisecond, MaxInterval: 100 * time.Millisecond},
+		AckTimeout: 50 * time.Millisecond,
+	}
+	conn := NewConn(cfg, ws.Dialer{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Run(ctx, func([]byte) {}, func() {
+			connected <- struct{}{}
+		})
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+	require.NoError(t, conn.Write(Message{Data: []byte(`{"event":"add"}`)}))
+	var sent []domain.Envelope
+	for i := 0; i < 2; i++ {
+		select {
+		case envelope := <-envelopes:
+			sent = append(sent, envelope)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not sent")
+		}
+	}
+	// the same message is sent again with the next sequence number
+	assert.Equal(t, domain.EventEnvelope, *sent[0].Event)
+	assert.Equal(t, sent[0].Id, sent[1].Id)
+	assert.Equal(t, `{"event":"add"}`, sent[1].Message)
+	assert.Equal(t, sent[0].Seq+1, sent[1].Seq)
+	assert.Eventually(t, func() bool {
+		return conn.outbox.len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, conn.Close(5*time.Second))
+	<-done
+}
+
+func TestConnCloseWaitsForAcks(t *testing.T) {
+	acked := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = wsutil.ReadClientBinary(conn)
+		if err != nil {
+			return
+		}
+		event := domain.EventHelloResponse
+		data, _ := json.Marshal(domain.HelloResponse{Event: &event, Accepted: true, ProtocolVersion: domain.ProtocolVersion})
+		_ = wsutil.WriteServerBinary(conn, data)
+		// acknowledge the second transmission of messages only
+		seen := map[string]bool{}
+		for {
+			data, err := wsutil.ReadClientBinary(conn)
+			if err != nil {
+				return
+			}
+			var envelope domain.Envelope
+			_ = json.Unmarshal(data, &envelope)
+			if !seen[envelope.Id] {
+				seen[envelope.Id] = true
+				continue
+			}
+			event := domain.EventAck
+			data, _ = json.Marshal(domain.Ack{Event: &event, Id: envelope.Id, Seq: envelope.Seq})
+			_ = wsutil.WriteServerBinary(conn, data)
+			acked <- envelope.Id
+		}
+	}))
+	defer srv.Close()
+	cfg := config.Config{
+		Cluster:    "cluster-a",
+		Server:     "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Reconnect:  config.ReconnectConfig{InitialInterval: 10 * time.Millisecond, MaxInterval: 100 * time.Millisecond},
+		AckTimeout: 50 * time.Millisecond,
+	}
+	conn := NewConn(cfg, ws.Dialer{})
+	connected := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Run(context.Background(), func([]byte) {}, func() {
+			connected <- struct{}{}
+		})
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+	require.NoError(t, conn.Write(Message{Data: []byte(`{"event":"add"}`)}))
+	require.NoError(t, conn.Write(Message{Data: []byte(`{"event":"delete"}`)}))
+	assert.NoError(t, conn.Close(5*time.Second))
+	<-done
+	assert.Zero(t, conn.outbox.len())
+	assert.Len(t, acked, 2)
+}
+
+func TestConnDropsOtherEncodings(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			data, err := wsutil.ReadClientBinary(server)
+			if err != nil {
+				return
+			}
+			received <- data
+		}
+	}()
+	conn := NewConn(config.Config{Cluster: "cluster-a"}, ws.Dialer{})
+	conn.conn = client
+	conn.session = Session{ProtocolVersion: domain.ProtocolVersion}
+	// encoded before the session changed from CBOR to JSON
+	require.NoError(t, conn.Write(Message{Data: []byte("cbor"), Encoding: domain.EncodingCBOR}))
+	assert.Zero(t, conn.outbox.len())
+	require.NoError(t, conn.Write(Message{Data: []byte(`{"event":"add"}`), Encoding: domain.EncodingJSON}))
+	select {
+	case data := <-received:
+		var envelope domain.Envelope
+		require.NoError(t, json.Unmarshal(data, &envelope))
+		assert.Equal(t, `{"event":"add"}`, envelope.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not sent")
+	}
+	assert.Empty(t, received)
+	// the server missed the dropped message, it is resynced once the outbox drains
+	var resyncs int
+	resync := func() { resyncs++ }
+	event := domain.EventAck
+	ack, err := json.Marshal(domain.Ack{Event: &event, Id: "2"})
+	require.NoError(t, err)
+	require.NoError(t, conn.receive(ack, func([]byte) {}, resync))
+	assert.Equal(t, 1, resyncs)
+	require.NoError(t, conn.receive(ack, func([]byte) {}, resync))
+	assert.Equal(t, 1, resyncs)
+}
+
+func TestConnHelloTimeout(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never answer hello
+		attempts.Add(1)
+		_, _ = wsutil.ReadClientBinary(conn)
+		_, _ = wsutil.ReadClientBinary(conn)
+	}))
+	defer srv.Close()
+	cfg := config.Config{
+		Cluster: "cluster-a",
+		Server:  "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Reconnect: config.ReconnectConfig{
+			InitialInterval: 10 * time.Millisecond,
+			MaxInterval:     10 * time.Millisecond,
+		},
+	}
+	run := func(helloTimeout time.Duration) (context.CancelFunc, <-chan struct{}) {
+		conn := NewConn(cfg, ws.Dialer{})
+		conn.helloTimeout = helloTimeout
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn.Run(ctx, func([]byte) {}, func() {
+				t.Error("connected without hello response")
+			})
+		}()
+		return cancel, done
+	}
+
+	// the handshake times out and is retried
+	cancel, done := run(50 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return attempts.Load() > 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	// a pending handshake is interrupted when ctx is done
+	attempts.Store(0)
+	cancel, done = run(time.Hour)
+	assert.Eventually(t, func() bool {
+		return attempts.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
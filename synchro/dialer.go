@@ -0,0 +1,45 @@
+package synchro
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gobwas/ws"
+	"github.com/matthyx/synchro-poc/config"
+)
+
+// NewDialer returns a websocket dialer presenting the configured credentials:
+// a bearer token and/or a client certificate.
+func NewDialer(cfg config.Config) (ws.Dialer, error) {
+	dialer := ws.Dialer{}
+	if cfg.Token != "" {
+		dialer.Header = ws.HandshakeHeaderHTTP(http.Header{
+			"Authorization": []string{"Bearer " + cfg.Token},
+		})
+	}
+	if cfg.TLS.CAFile != "" || cfg.TLS.CertFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.TLS.CAFile != "" {
+			ca, err := os.ReadFile(cfg.TLS.CAFile)
+			if err != nil {
+				return ws.Dialer{}, fmt.Errorf("read server CA: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return ws.Dialer{}, fmt.Errorf("no certificate found in %s", cfg.TLS.CAFile)
+			}
+		}
+		if cfg.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				return ws.Dialer{}, fmt.Errorf("load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		dialer.TLSConfig = tlsConfig
+	}
+	return dialer, nil
+}
@@ -0,0 +1,117 @@
+package synchro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+)
+
+// Session holds the protocol revision and the capabilities negotiated with the server.
+type Session struct {
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+// Has tells if a capability was advertised by both sides.
+func (s Session) Has(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Codec returns the codec of the messages following helloResponse.
+func (s Session) Codec() domain.Codec {
+	return domain.NewCodec(s.ProtocolVersion, s.Capabilities)
+}
+
+// offer is the range of revisions and the capabilities advertised in hello.
+type offer struct {
+	minProtocolVersion int
+	protocolVersion    int
+	capabilities       []string
+}
+
+// newOffer returns the offer of this version, CBOR is only advertised if configured.
+func newOffer(cfg config.Config) offer {
+	o := offer{
+		minProtocolVersion: domain.MinProtocolVersion,
+		protocolVersion:    domain.ProtocolVersion,
+		capabilities:       domain.Capabilities,
+	}
+	if cfg.Encoding == domain.EncodingCBOR {
+		o.capabilities = append(append([]string{}, domain.Capabilities...), domain.CapabilityCBOR)
+	}
+	return o
+}
+
+// Handshake opens a session by sending the hello message, it fails if the
+// server rejects the session.
+func Handshake(conn io.ReadWriter, cfg config.Config) error {
+	_, err := handshake(conn, cfg, newOffer(cfg))
+	return err
+}
+
+func handshake(conn io.ReadWriter, cfg config.Config, o offer) (*Session, error) {
+	event := domain.EventHello
+	hello := domain.Hello{
+		Event:              &event,
+		Cluster:            cfg.Cluster,
+		ClientVersion:      domain.Version,
+		ProtocolVersion:    o.protocolVersion,
+		MinProtocolVersion: o.minProtocolVersion,
+		Capabilities:       o.capabilities,
+	}
+	for _, r := range cfg.Resources {
+		ignorePaths, err := r.IgnorePaths()
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum ignore path for %s: %w", r.String(), err)
+		}
+		hello.Resources = append(hello.Resources, domain.Resource{
+			Kind: &domain.Kind{
+				Group:    r.Group,
+				Version:  r.Version,
+				Resource: r.Resource,
+			},
+			Strategy:       r.Strategy,
+			ChecksumIgnore: ignorePaths,
+		})
+	}
+	data, err := json.Marshal(hello)
+	if err != nil {
+		return nil, fmt.Errorf("marshal hello message: %w", err)
+	}
+	err = wsutil.WriteClientBinary(conn, data)
+	if err != nil {
+		return nil, fmt.Errorf("send hello message: %w", err)
+	}
+	data, err = wsutil.ReadServerBinary(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read hello response: %w", err)
+	}
+	var resp domain.HelloResponse
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal hello response: %w", err)
+	}
+	if resp.Event == nil || *resp.Event != domain.EventHelloResponse {
+		return nil, errors.New("unexpected response to hello")
+	}
+	if !resp.Accepted {
+		return nil, fmt.Errorf("session rejected by server %s (protocol version %d): %s", resp.ServerVersion, resp.ProtocolVersion, resp.Reason)
+	}
+	if resp.ProtocolVersion < o.minProtocolVersion || resp.ProtocolVersion > o.protocolVersion {
+		return nil, fmt.Errorf("server %s speaks unsupported protocol version %d", resp.ServerVersion, resp.ProtocolVersion)
+	}
+	return &Session{
+		ProtocolVersion: resp.ProtocolVersion,
+		Capabilities:    domain.IntersectCapabilities(o.capabilities, resp.Capabilities),
+	}, nil
+}
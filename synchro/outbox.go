@@ -0,0 +1,176 @@
+package synchro
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+)
+
+// outboxSize bounds the messages waiting for an acknowledgement, the oldest
+// ones are dropped beyond it and the server is resynced once the outbox drains
+const outboxSize = 10000
+
+type outMessage struct {
+	id   string
+	data []byte
+	// encoding is the name of the codec of data, empty if unknown
+	encoding string
+	// sent is the time of the last transmission, zero if not sent on the current connection
+	sent time.Time
+}
+
+// outbox holds the messages sent to the server until they are acknowledged,
+// in the order they were added.
+type outbox struct {
+	mu       sync.Mutex
+	nextID   uint64
+	messages *list.List
+	byID     map[string]*list.Element
+	// empty is closed while the outbox holds no message
+	empty chan struct{}
+	// lost is set when unacknowledged messages are dropped, until resyncDue
+	// reports it once the outbox is empty
+	lost bool
+}
+
+func newOutbox() *outbox {
+	empty := make(chan struct{})
+	close(empty)
+	return &outbox{
+		messages: list.New(),
+		byID:     map[string]*list.Element{},
+		empty:    empty,
+	}
+}
+
+// add queues a message and assigns its ID.
+func (o *outbox) add(data []byte, encoding string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.messages.Len() >= outboxSize {
+		oldest := o.messages.Remove(o.messages.Front()).(*outMessage)
+		delete(o.byID, oldest.id)
+		o.lost = true
+		logger.L().Warning("outbox full, dropping unacknowledged message", helpers.String("id", oldest.id))
+	}
+	if o.messages.Len() == 0 {
+		o.empty = make(chan struct{})
+	}
+	o.nextID++
+	msg := &outMessage{
+		id:       strconv.FormatUint(o.nextID, 10),
+		data:     data,
+		encoding: encoding,
+	}
+	o.byID[msg.id] = o.messages.PushBack(msg)
+}
+
+// ack removes an acknowledged message, acknowledgements of unknown messages are ignored.
+func (o *outbox) ack(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.remove(id)
+}
+
+// drop removes a message that cannot be sent, the server is resynced once the
+// outbox is empty.
+func (o *outbox) drop(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.remove(id) {
+		o.lost = true
+	}
+}
+
+// remove removes a message, o.mu must be held.
+func (o *outbox) remove(id string) bool {
+	elem, ok := o.byID[id]
+	if !ok {
+		return false
+	}
+	o.messages.Remove(elem)
+	delete(o.byID, id)
+	if o.messages.Len() == 0 {
+		close(o.empty)
+	}
+	return true
+}
+
+// due returns the messages never sent or not acknowledged within timeout,
+// and marks them as sent at now.
+func (o *outbox) due(now time.Time, timeout time.Duration) []outMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var msgs []outMessage
+	for elem := o.messages.Front(); elem != nil; elem = elem.Next() {
+		msg := elem.Value.(*outMessage)
+		if msg.sent.IsZero() || now.Sub(msg.sent) >= timeout {
+			msg.sent = now
+			msgs = append(msgs, *msg)
+		}
+	}
+	return msgs
+}
+
+// reset marks all messages as not sent, they are sent again on the next connection.
+func (o *outbox) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for elem := o.messages.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*outMessage).sent = time.Time{}
+	}
+}
+
+// retain drops the messages encoded for another encoding and returns their count,
+// messages of unknown encoding are kept.
+func (o *outbox) retain(encoding string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	dropped := 0
+	for elem := o.messages.Front(); elem != nil; {
+		next := elem.Next()
+		msg := elem.Value.(*outMessage)
+		if msg.encoding != "" && msg.encoding != encoding {
+			o.messages.Remove(elem)
+			delete(o.byID, msg.id)
+			dropped++
+		}
+		elem = next
+	}
+	if dropped > 0 {
+		o.lost = true
+		if o.messages.Len() == 0 {
+			close(o.empty)
+		}
+	}
+	return dropped
+}
+
+// resyncDue tells, once, that messages were dropped since the last call and
+// that the outbox is now empty, so that a resync is not dropped in turn.
+func (o *outbox) resyncDue() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.lost || o.messages.Len() > 0 {
+		return false
+	}
+	o.lost = false
+	return true
+}
+
+// drained returns a channel closed once all the messages are acknowledged.
+func (o *outbox) drained() <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.empty
+}
+
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.messages.Len()
+}
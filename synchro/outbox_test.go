@@ -0,0 +1,108 @@
+package synchro
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	o := newOutbox()
+	o.add([]byte("a"), "json")
+	o.add([]byte("b"), "json")
+	now := time.Now()
+	due := o.due(now, time.Second)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, "1", due[0].id)
+		assert.Equal(t, []byte("a"), due[0].data)
+		assert.Equal(t, "2", due[1].id)
+	}
+	// not sent again before the timeout
+	assert.Empty(t, o.due(now.Add(time.Millisecond), time.Second))
+	assert.True(t, o.ack("1"))
+	assert.False(t, o.ack("1"))
+	due = o.due(now.Add(time.Second), time.Second)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "2", due[0].id)
+	}
+	// sent again right away on a new connection
+	o.reset()
+	assert.Len(t, o.due(now.Add(time.Second), time.Second), 1)
+	assert.Equal(t, 1, o.len())
+}
+
+func TestOutboxRetainsEncoding(t *testing.T) {
+	o := newOutbox()
+	o.add([]byte("before session"), "")
+	o.add([]byte("json"), "json")
+	o.add([]byte("cbor"), "cbor")
+	assert.Equal(t, 1, o.retain("cbor"))
+	assert.Equal(t, 2, o.len())
+	due := o.due(time.Now(), time.Second)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, []byte("before session"), due[0].data)
+		assert.Equal(t, []byte("cbor"), due[1].data)
+	}
+	assert.False(t, o.ack("2"))
+	assert.Equal(t, 1, o.retain("json"))
+}
+
+func TestOutboxDropsOldest(t *testing.T) {
+	o := newOutbox()
+	for i := 0; i <= outboxSize; i++ {
+		o.add([]byte("m"), "json")
+	}
+	assert.Equal(t, outboxSize, o.len())
+	assert.False(t, o.ack("1"))
+	assert.True(t, o.ack("2"))
+}
+
+func TestOutboxResyncDue(t *testing.T) {
+	o := newOutbox()
+	o.add([]byte("a"), "json")
+	assert.True(t, o.ack("1"))
+	assert.False(t, o.resyncDue())
+	// dropped when full
+	for i := 0; i <= outboxSize; i++ {
+		o.add([]byte("m"), "json")
+	}
+	assert.False(t, o.resyncDue(), "not before the outbox drains")
+	for _, msg := range o.due(time.Now(), time.Second) {
+		o.ack(msg.id)
+	}
+	assert.True(t, o.resyncDue())
+	assert.False(t, o.resyncDue())
+	// dropped for another encoding
+	o.add([]byte("b"), "cbor")
+	assert.Equal(t, 1, o.retain("json"))
+	assert.True(t, o.resyncDue())
+	// dropped when sending
+	o.add([]byte("c"), "cbor")
+	o.drop(strconv.FormatUint(o.nextID, 10))
+	assert.True(t, o.resyncDue())
+}
+
+func TestOutboxDrained(t *testing.T) {
+	o := newOutbox()
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	assert.True(t, isClosed(o.drained()))
+	o.add([]byte("a"), "json")
+	o.add([]byte("b"), "cbor")
+	drained := o.drained()
+	assert.False(t, isClosed(drained))
+	assert.True(t, o.ack("1"))
+	assert.False(t, isClosed(drained))
+	assert.Equal(t, 1, o.retain("json"))
+	assert.True(t, isClosed(drained))
+	o.add([]byte("c"), "json")
+	assert.False(t, isClosed(o.drained()))
+}
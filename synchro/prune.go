@@ -0,0 +1,78 @@
+package synchro
+
+import (
+	"github.com/matthyx/synchro-poc/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const redacted = "REDACTED"
+
+// pruner drops or redacts fields of the objects before they are hashed and
+// sent, at paths parsed by utils.ParsePath.
+type pruner struct {
+	drop   [][]string
+	redact [][]string
+}
+
+func newPruner(drop, redact []string) (*pruner, error) {
+	p := &pruner{}
+	for _, path := range drop {
+		segments, err := utils.ParsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		p.drop = append(p.drop, segments)
+	}
+	for _, path := range redact {
+		segments, err := utils.ParsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		p.redact = append(p.redact, segments)
+	}
+	return p, nil
+}
+
+// marshal returns the pruned JSON of obj, which is left untouched.
+func (p *pruner) marshal(obj *unstructured.Unstructured) ([]byte, error) {
+	if len(p.drop) == 0 && len(p.redact) == 0 {
+		return obj.MarshalJSON()
+	}
+	pruned := obj.DeepCopy()
+	for _, path := range p.drop {
+		prunePath(pruned.Object, path, false)
+	}
+	for _, path := range p.redact {
+		prunePath(pruned.Object, path, true)
+	}
+	return pruned.MarshalJSON()
+}
+
+func prunePath(value interface{}, path []string, redact bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			return
+		}
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) > 1 {
+			prunePath(child, path[1:], redact)
+			return
+		}
+		if redact {
+			v[path[0]] = redacted
+		} else {
+			delete(v, path[0])
+		}
+	case []interface{}:
+		if path[0] != "*" {
+			return
+		}
+		for i := range v {
+			prunePath(v[i], path[1:], redact)
+		}
+	}
+}
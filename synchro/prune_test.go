@@ -0,0 +1,96 @@
+package synchro
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/matthyx/synchro-poc/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPrunerMarshal(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":            "nginx",
+			"resourceVersion": "42",
+			"annotations": map[string]interface{}{
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				"team": "web",
+			},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "nginx", "env": []interface{}{
+					map[string]interface{}{"name": "PASSWORD", "value": "secret"},
+				}},
+				map[string]interface{}{"name": "sidecar"},
+			},
+		},
+	}}
+	p, err := newPruner(
+		[]string{"metadata.resourceVersion", "metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']", "status"},
+		[]string{"spec.containers[*].env[*].value"},
+	)
+	require.NoError(t, err)
+	data, err := p.marshal(obj)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"metadata": {"name": "nginx", "annotations": {"team": "web"}},
+		"spec": {"containers": [
+			{"name": "nginx", "env": [{"name": "PASSWORD", "value": "REDACTED"}]},
+			{"name": "sidecar"}
+		]}
+	}`, string(data))
+	// the original object is untouched
+	assert.Equal(t, "42", obj.GetResourceVersion())
+	assert.Len(t, obj.GetAnnotations(), 2)
+	// invalid rules
+	_, err = newPruner([]string{"spec.containers[*]"}, nil)
+	assert.Error(t, err)
+}
+
+func TestClientDefaultDrop(t *testing.T) {
+	pod := newPod("default", "nginx")
+	pod.SetResourceVersion("42")
+	pod.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationApply}})
+	pod.SetLabels(map[string]string{"app": "web"})
+	// configured paths are dropped along with the defaults
+	for _, drop := range [][]string{nil, {"metadata.labels"}} {
+		pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, Drop: drop}
+		syncClient, _, _ := newTestClient(t, pods, pod)
+		syncInformer(t, syncClient)
+		objects, _, err := syncClient.listObjects(context.Background(), "")
+		require.NoError(t, err)
+		var obj unstructured.Unstructured
+		require.NoError(t, json.Unmarshal(objects["default/nginx"], &obj.Object))
+		assert.Empty(t, obj.GetResourceVersion())
+		assert.Empty(t, obj.GetManagedFields())
+		assert.Equal(t, "nginx", obj.GetName())
+		assert.Equal(t, drop == nil, obj.GetLabels() != nil)
+	}
+}
+
+func TestClientChecksumIgnore(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, ChecksumIgnore: []string{"metadata.labels"}}
+	syncClient, _, _ := newTestClient(t, pods)
+	assert.Equal(t, append(append([]string{}, utils.DefaultIgnorePaths...), ".metadata.labels"), syncClient.ignorePaths)
+	withLabels, err := syncClient.checksum([]byte(`{"metadata":{"name":"nginx","labels":{"app":"web"}}}`))
+	require.NoError(t, err)
+	withoutLabels, err := syncClient.checksum([]byte(`{"metadata":{"name":"nginx"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, withoutLabels, withLabels)
+	// defaults
+	pods.ChecksumIgnore = nil
+	syncClient, _, _ = newTestClient(t, pods)
+	assert.Equal(t, utils.DefaultIgnorePaths, syncClient.ignorePaths)
+	// invalid paths
+	pods.ChecksumIgnore = []string{"spec.containers[*].image"}
+	_, err = NewClient(config.Config{}, nil, nil, pods)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package synchro
+
+import (
+	"fmt"
+
+	"github.com/matthyx/synchro-poc/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// selector restricts the objects synchronized for a resource. The list and
+// watch calls are filtered by the API server, the selector is evaluated again
+// on each change to find the objects that stopped matching.
+type selector struct {
+	namespaces        map[string]bool
+	excludeNamespaces map[string]bool
+	labels            labels.Selector
+	fields            fields.Selector
+}
+
+func newSelector(r config.Resource) (*selector, error) {
+	s := &selector{
+		namespaces:        map[string]bool{},
+		excludeNamespaces: map[string]bool{},
+		labels:            labels.Everything(),
+		fields:            fields.Everything(),
+	}
+	var err error
+	if r.LabelSelector != "" {
+		s.labels, err = labels.Parse(r.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parse label selector: %w", err)
+		}
+	}
+	if r.FieldSelector != "" {
+		s.fields, err = fields.ParseSelector(r.FieldSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parse field selector: %w", err)
+		}
+	}
+	for _, ns := range r.Namespaces {
+		s.namespaces[ns] = true
+	}
+	for _, ns := range r.ExcludeNamespaces {
+		s.excludeNamespaces[ns] = true
+		s.fields = fields.AndSelectors(s.fields, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+	return s, nil
+}
+
+// tweakListOptions applies the selectors to the list and watch calls.
+func (s *selector) tweakListOptions(opts *metav1.ListOptions) {
+	if !s.labels.Empty() {
+		opts.LabelSelector = s.labels.String()
+	}
+	if !s.fields.Empty() {
+		opts.FieldSelector = s.fields.String()
+	}
+}
+
+// matches evaluates the namespaces and the label selector, field selectors
+// cannot be evaluated on arbitrary objects and are left to the API server.
+func (s *selector) matches(obj *unstructured.Unstructured) bool {
+	ns := obj.GetNamespace()
+	if len(s.namespaces) > 0 && !s.namespaces[ns] {
+		return false
+	}
+	if s.excludeNamespaces[ns] {
+		return false
+	}
+	return s.labels.Matches(labels.Set(obj.GetLabels()))
+}
@@ -0,0 +1,76 @@
+package synchro
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newLabeledPod(ns, name, app string) *unstructured.Unstructured {
+	pod := newPod(ns, name)
+	pod.SetLabels(map[string]string{"app": app})
+	return pod
+}
+
+func TestSelectorListOptions(t *testing.T) {
+	sel, err := newSelector(config.Resource{
+		ExcludeNamespaces: []string{"kube-system"},
+		LabelSelector:     "app in (web,db)",
+		FieldSelector:     "spec.nodeName=node-1",
+	})
+	require.NoError(t, err)
+	var opts metav1.ListOptions
+	sel.tweakListOptions(&opts)
+	assert.Equal(t, "app in (db,web)", opts.LabelSelector)
+	assert.Equal(t, "spec.nodeName=node-1,metadata.namespace!=kube-system", opts.FieldSelector)
+	assert.True(t, sel.matches(newLabeledPod("default", "nginx", "web")))
+	assert.False(t, sel.matches(newLabeledPod("default", "nginx", "cache")))
+	assert.False(t, sel.matches(newLabeledPod("kube-system", "coredns", "web")))
+	// nothing is set without selectors
+	sel, err = newSelector(config.Resource{})
+	require.NoError(t, err)
+	opts = metav1.ListOptions{}
+	sel.tweakListOptions(&opts)
+	assert.Empty(t, opts.LabelSelector)
+	assert.Empty(t, opts.FieldSelector)
+	// invalid selectors
+	_, err = newSelector(config.Resource{LabelSelector: "app in web"})
+	assert.Error(t, err)
+	_, err = newSelector(config.Resource{FieldSelector: "spec.nodeName"})
+	assert.Error(t, err)
+}
+
+func TestClientNamespaces(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, Namespaces: []string{"default", "web"}}
+	syncClient, _, _ := newTestClient(t, pods, newPod("default", "nginx"), newPod("web", "redis"), newPod("kube-system", "coredns"))
+	syncInformer(t, syncClient)
+	objects, _, err := syncClient.listObjects(context.Background(), "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+	assert.Contains(t, objects, "default/nginx")
+	assert.Contains(t, objects, "web/redis")
+	// not watched
+	assert.Error(t, syncClient.HandleSyncRetrieve("kube-system/coredns"))
+}
+
+func TestRunDeletesObjectsNotMatching(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy, LabelSelector: "app=web"}
+	calls, sent, _, _ := startWatching(t, pods)
+	assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+	watcher := nextCall(t, calls).watcher
+	watcher.Add(newLabeledPod("default", "nginx", "web"))
+	assert.Equal(t, [][2]string{{"checksum", "default/nginx"}}, nextMessages(t, sent, 1))
+	// the object stops matching the label selector
+	watcher.Modify(newLabeledPod("default", "nginx", "cache"))
+	assert.Equal(t, [][2]string{{"delete", "default/nginx"}}, nextMessages(t, sent, 1))
+	// and matches again
+	watcher.Modify(newLabeledPod("default", "nginx", "web"))
+	assert.Equal(t, [][2]string{{"checksum", "default/nginx"}}, nextMessages(t, sent, 1))
+	assert.Empty(t, sent)
+}
@@ -0,0 +1,44 @@
+package synchro
+
+import "sync"
+
+// shadow holds the last object sent to the server for each key, the base of the
+// patches of the patch strategy. It is written by the worker processing watch
+// events and by the handlers of the server messages.
+type shadow struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+func newShadow() *shadow {
+	return &shadow{
+		objects: map[string][]byte{},
+	}
+}
+
+// get returns the object of key, if any.
+func (s *shadow) get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// put replaces the object of key, object must not be modified afterwards.
+func (s *shadow) put(key string, object []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = object
+}
+
+func (s *shadow) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+}
+
+func (s *shadow) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.objects)
+}
@@ -0,0 +1,117 @@
+package synchro
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestShadow(t *testing.T) {
+	s := newShadow()
+	_, ok := s.get("default/nginx")
+	assert.False(t, ok)
+	s.put("default/nginx", []byte(`{"v":1}`))
+	s.put("default/nginx", []byte(`{"v":2}`))
+	object, ok := s.get("default/nginx")
+	assert.True(t, ok)
+	assert.Equal(t, []byte(`{"v":2}`), object)
+	assert.Equal(t, 1, s.len())
+	s.delete("default/nginx")
+	s.delete("default/unknown")
+	_, ok = s.get("default/nginx")
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.len())
+}
+
+func TestShadowConcurrentWriters(t *testing.T) {
+	s := newShadow()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("default/nginx-%d", i%10)
+				switch (w + i) % 3 {
+				case 0:
+					s.put(key, []byte(`{}`))
+				case 1:
+					s.get(key)
+				case 2:
+					s.delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, s.len(), 10)
+}
+
+// TestShadowConcurrentAccess delivers watch events to the worker while the
+// server messages are handled, to be run with the race detector.
+func TestShadowConcurrentAccess(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.PatchStrategy}
+	const count = 10
+	var objects []runtime.Object
+	for i := 0; i < count; i++ {
+		objects = append(objects, newPod("default", fmt.Sprintf("nginx-%d", i)))
+	}
+	syncClient, client, sent := newTestClient(t, pods, objects...)
+	calls := watchCalls(client, pods)
+	runClient(t, syncClient)
+	first := nextCall(t, calls)
+	stop := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-sent:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// watch events
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			pod := newPod("default", fmt.Sprintf("nginx-%d", i%count))
+			pod.SetResourceVersion(fmt.Sprint(100 + i))
+			if i%2 == 0 {
+				first.watcher.Delete(pod)
+			} else {
+				first.watcher.Add(pod)
+			}
+		}
+	}()
+	// server messages, failures of objects deleted meanwhile are expected
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("default/nginx-%d", i%count)
+			_ = syncClient.HandleSyncUpdateShadow(key, []byte(`{}`))
+			_ = syncClient.HandleSyncRetrieve(key)
+		}
+	}()
+	wg.Wait()
+	assert.Eventually(t, func() bool {
+		return syncClient.queue.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	close(stop)
+	<-drained
+	// the last event of odd objects is an update, they are retrieved into the shadow
+	syncClient.resources.delete("default/nginx-1")
+	assert.NoError(t, syncClient.HandleSyncRetrieve("default/nginx-1"))
+	_, ok := syncClient.resources.get("default/nginx-1")
+	assert.True(t, ok)
+}
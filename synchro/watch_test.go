@@ -0,0 +1,186 @@
+package synchro
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matthyx/synchro-poc/config"
+	"github.com/matthyx/synchro-poc/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+type watchCall struct {
+	resourceVersion string
+	watcher         *watch.FakeWatcher
+}
+
+// startWatching runs the client with a fake watch reactor, each watch call is
+// sent to the returned channel.
+func startWatching(t *testing.T, r config.Resource, objects ...runtime.Object) (chan watchCall, chan []byte, func(ns, name string), func(obj runtime.Object)) {
+	syncClient, client, sent := newTestClient(t, r, objects...)
+	calls := watchCalls(client, r)
+	runClient(t, syncClient)
+	gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+	remove := func(ns, name string) {
+		require.NoError(t, client.Tracker().Delete(gvr, ns, name))
+	}
+	add := func(obj runtime.Object) {
+		require.NoError(t, client.Tracker().Add(obj))
+	}
+	return calls, sent, remove, add
+}
+
+// watchCalls replaces the watches of client by fake watchers, sent to the returned channel.
+func watchCalls(client *dynamicfake.FakeDynamicClient, r config.Resource) chan watchCall {
+	calls := make(chan watchCall, 10)
+	client.PrependWatchReactor(r.Resource, func(action clienttesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFakeWithChanSize(10, false)
+		calls <- watchCall{
+			resourceVersion: action.(clienttesting.WatchAction).GetWatchRestrictions().ResourceVersion,
+			watcher:         watcher,
+		}
+		return true, watcher, nil
+	})
+	return calls
+}
+
+// runClient runs c until the end of the test.
+func runClient(t *testing.T, c *Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func nextCall(t *testing.T, calls chan watchCall) watchCall {
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not started")
+	}
+	return watchCall{}
+}
+
+// nextMessages returns the event and name of the next n sent messages, sorted by name.
+func nextMessages(t *testing.T, sent chan []byte, n int) [][2]string {
+	var messages [][2]string
+	for i := 0; i < n; i++ {
+		select {
+		case data := <-sent:
+			var msg struct {
+				Event *domain.Event
+				Name  string
+			}
+			require.NoError(t, json.Unmarshal(data, &msg))
+			messages = append(messages, [2]string{msg.Event.Value().(string), msg.Name})
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not sent")
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i][1] < messages[j][1]
+	})
+	return messages
+}
+
+func TestRunResumesWatch(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	calls, sent, _, _ := startWatching(t, pods, newPod("default", "nginx"))
+	assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+	first := nextCall(t, calls)
+	pod := newPod("default", "redis")
+	pod.SetResourceVersion("10")
+	first.watcher.Add(pod)
+	assert.Equal(t, [][2]string{{"checksum", "default/redis"}}, nextMessages(t, sent, 1))
+	// bookmarks only move the resource version
+	bookmark := newPod("", "")
+	bookmark.SetResourceVersion("12")
+	first.watcher.Action(watch.Bookmark, bookmark)
+	// the watch times out, it is resumed from the last seen resource version
+	first.watcher.Stop()
+	second := nextCall(t, calls)
+	assert.Equal(t, "12", second.resourceVersion)
+	assert.Empty(t, sent)
+}
+
+func TestRunRelistsWhenExpired(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	calls, sent, remove, add := startWatching(t, pods, newPod("default", "nginx"), newPod("default", "redis"))
+	assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+	first := nextCall(t, calls)
+	pod := newPod("default", "web")
+	pod.SetResourceVersion("10")
+	first.watcher.Add(pod)
+	assert.Equal(t, [][2]string{{"checksum", "default/web"}}, nextMessages(t, sent, 1))
+	// changes missed while the watch was down
+	remove("default", "redis")
+	add(newPod("default", "mysql"))
+	first.watcher.Error(&metav1.Status{
+		Status: metav1.StatusFailure,
+		Code:   410,
+		Reason: metav1.StatusReasonExpired,
+	})
+	// the relist sends the differences with the known objects only
+	assert.Equal(t, [][2]string{
+		{"checksum", "default/mysql"},
+		{"delete", "default/redis"},
+		{"delete", "default/web"},
+	}, nextMessages(t, sent, 3))
+	second := nextCall(t, calls)
+	assert.NotEqual(t, "10", second.resourceVersion)
+	assert.Empty(t, sent)
+}
+
+func TestRunRetriesFailedSends(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	syncClient, client, sent := newTestClient(t, pods, newPod("default", "nginx"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		syncClient.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	assert.Equal(t, [][2]string{{"digest", ""}}, nextMessages(t, sent, 1))
+	// sending fails until the pool is rebooted
+	syncClient.outPool.Release()
+	require.NoError(t, client.Tracker().Add(newPod("default", "redis")))
+	assert.Eventually(t, func() bool {
+		return syncClient.queue.NumRequeues("default/redis") > 0
+	}, 5*time.Second, time.Millisecond)
+	syncClient.outPool.Reboot()
+	assert.Equal(t, [][2]string{{"checksum", "default/redis"}}, nextMessages(t, sent, 1))
+}
+
+func TestHandleSyncRetrieveFromCache(t *testing.T) {
+	pods := config.Resource{Version: "v1", Resource: "pods", Strategy: domain.CopyStrategy}
+	syncClient, client, sent := newTestClient(t, pods, newPod("default", "nginx"))
+	syncInformer(t, syncClient)
+	client.PrependReactor("get", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unexpected get")
+	})
+	require.NoError(t, syncClient.HandleSyncRetrieve("default/nginx"))
+	assert.Equal(t, [][2]string{{"add", "default/nginx"}}, nextMessages(t, sent, 1))
+	assert.Error(t, syncClient.HandleSyncRetrieve("default/unknown"))
+}
@@ -23,18 +23,102 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
+// DefaultIgnorePaths are the paths ignored by CanonicalHash.
+var DefaultIgnorePaths = []string{
+	".status.conditions", // avoid Pod.status.conditions.lastProbeTime: null
+}
+
 func CanonicalHash(in []byte) (string, error) {
-	hash, err := jsonhash.CalculateJsonHash(in, []string{
-		".status.conditions", // avoid Pod.status.conditions.lastProbeTime: null
-	})
+	return CanonicalHashIgnoring(in, DefaultIgnorePaths)
+}
+
+// CanonicalHashIgnoring hashes in without the values at the ignored paths,
+// written as .field.subfield
+func CanonicalHashIgnoring(in []byte, ignorePaths []string) (string, error) {
+	hash, err := jsonhash.CalculateJsonHash(in, ignorePaths)
 	if err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(hash[:]), nil
 }
 
+// ParsePath parses the path of a field in an object, written as dot-separated
+// field names where [*] matches all the items of a list and ['name'] quotes a
+// field name containing dots, e.g.
+//
+//	spec.containers[*].env
+//	metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']
+func ParsePath(path string) ([]string, error) {
+	var segments []string
+	rest := strings.TrimPrefix(path, "$.")
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "[*]"):
+			segments = append(segments, "*")
+			rest = rest[len("[*]"):]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted field in path %q", path)
+			}
+			segments = append(segments, rest[2:end])
+			rest = rest[end+2:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty field in path %q", path)
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path %q", path)
+	}
+	if segments[len(segments)-1] == "*" {
+		return nil, fmt.Errorf("path %q cannot end with [*]", path)
+	}
+	return segments, nil
+}
+
+// IgnorePath converts a path parsed by ParsePath to the .field.subfield syntax
+// of CanonicalHashIgnoring, which supports neither [*] nor quoted field names.
+func IgnorePath(path string) (string, error) {
+	segments, err := ParsePath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range segments {
+		if segment == "*" || strings.Contains(segment, ".") {
+			return "", fmt.Errorf("checksum ignore path %q cannot match list items or quote field names", path)
+		}
+	}
+	return "." + strings.Join(segments, "."), nil
+}
+
+// CheckIgnorePath validates a path ignored by CanonicalHashIgnoring.
+func CheckIgnorePath(path string) error {
+	if !strings.HasPrefix(path, ".") {
+		return fmt.Errorf("ignore path %q must start with a dot", path)
+	}
+	for _, field := range strings.Split(path[1:], ".") {
+		if field == "" {
+			return fmt.Errorf("ignore path %q has an empty field", path)
+		}
+	}
+	return nil
+}
+
 func KeyToNsName(key string) (string, string) {
-	split := strings.Split(key, "/")
+	split := strings.SplitN(key, "/", 2)
+	if len(split) < 2 {
+		// cluster-scoped objects may be sent without the leading separator
+		return "", key
+	}
 	return split[0], split[1]
 }
 
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		segments []string
+		wantErr  bool
+	}{
+		{path: "metadata.managedFields", segments: []string{"metadata", "managedFields"}},
+		{path: "$.spec.containers[*].env", segments: []string{"spec", "containers", "*", "env"}},
+		{path: "metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']", segments: []string{"metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration"}},
+		{path: "", wantErr: true},
+		{path: "spec..containers", wantErr: true},
+		{path: "spec.containers[*]", wantErr: true},
+		{path: "metadata.annotations['unterminated", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			segments, err := ParsePath(tt.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.segments, segments)
+		})
+	}
+}
+
+func TestIgnorePath(t *testing.T) {
+	path, err := IgnorePath("$.metadata.labels")
+	assert.NoError(t, err)
+	assert.Equal(t, ".metadata.labels", path)
+	assert.NoError(t, CheckIgnorePath(path))
+	for _, invalid := range []string{"", "spec.containers[*].image", "metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']"} {
+		_, err := IgnorePath(invalid)
+		assert.Error(t, err, invalid)
+	}
+}